@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runBatch implements `thumbs-server batch [flags] [FILE...]`. It reads IDs
+// from the files, or stdin if there are none, and writes the converted IDs
+// to stdout in the same format. Files are converted one after the other,
+// so every CSV file has its own header row. Records that fail to convert
+// are kept so that the output lines up with the input, and their error is
+// reported on stderr (lines), in an `error` column (CSV) or an `error`
+// field (JSONL).
+func runBatch(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	op := fs.String("op", "encode", "Conversion to apply: 'encode' or 'decode'")
+	format := fs.String("format", "lines", "Input and output format: 'lines', 'csv' (with a header row) or 'jsonl'")
+	field := fs.String("field", "", "CSV column or JSONL field holding the input ID (default 'video_id' for encode, 'id' for decode)")
+	out := fs.String("out", "", "CSV column or JSONL field the result is written to (default 'id' for encode, 'video_id' for decode)")
+	expires := fs.String("expires", "", "Unix timestamp after which the encoded IDs stop working")
+	expiresIn := fs.String("expires-in", "", "Lifetime of the encoded IDs, in seconds or as a duration like 24h")
+	allowExpired := fs.Bool("allow-expired", false, "Decode expiring IDs even after they have expired")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: thumbs-server batch [flags] [FILE...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var convert converter
+	switch *op {
+	case "encode":
+		var err error
+		if convert, err = encoder(*expires, *expiresIn); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		defaultString(field, "video_id")
+		defaultString(out, "id")
+	case "decode":
+		convert = decoder(*allowExpired)
+		defaultString(field, "id")
+		defaultString(out, "video_id")
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown op '%s', expected 'encode' or 'decode'\n", *op)
+		return exitUsage
+	}
+
+	var batch batchFunc
+	switch *format {
+	case "lines":
+		batch = batchLines
+	case "csv":
+		batch = batchCSV
+	case "jsonl":
+		batch = batchJSONL
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format '%s', expected 'lines', 'csv' or 'jsonl'\n", *format)
+		return exitUsage
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if fs.NArg() == 0 {
+		status, err := batch(os.Stdin, w, convert, *field, *out)
+		if err != nil {
+			w.Flush()
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		return int(status)
+	}
+
+	var status exitStatus
+	for _, name := range fs.Args() {
+		fileStatus, err := batchFile(name, batch, w, convert, *field, *out)
+		if err != nil {
+			w.Flush()
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			return exitUsage
+		}
+		status.merge(fileStatus)
+	}
+	return int(status)
+}
+
+// batchFunc converts the IDs of one input, see batchLines, batchCSV and
+// batchJSONL.
+type batchFunc func(in io.Reader, w io.Writer, convert converter, field, out string) (exitStatus, error)
+
+// batchFile runs batch on one input file.
+func batchFile(name string, batch batchFunc, w io.Writer, convert converter, field, out string) (exitStatus, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return exitOK, err
+	}
+	defer f.Close()
+	return batch(f, w, convert, field, out)
+}
+
+func defaultString(s *string, value string) {
+	if *s == "" {
+		*s = value
+	}
+}
+
+// batchLines converts one ID per line. Empty lines are passed through.
+func batchLines(in io.Reader, w io.Writer, convert converter, _, _ string) (exitStatus, error) {
+	var status exitStatus
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" {
+			fmt.Fprintln(w)
+			continue
+		}
+		result, err := convert(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %s: %s\n", n, id, err)
+			status.fail(err)
+		}
+		fmt.Fprintln(w, result)
+	}
+	return status, scanner.Err()
+}
+
+// batchCSV converts the field column of a CSV file with a header row,
+// adding (or overwriting) the out and error columns.
+func batchCSV(in io.Reader, w io.Writer, convert converter, field, out string) (exitStatus, error) {
+	var status exitStatus
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	column := func(name string) int {
+		for i, h := range header {
+			if h == name {
+				return i
+			}
+		}
+		header = append(header, name)
+		return len(header) - 1
+	}
+	input := -1
+	for i, h := range header {
+		if h == field {
+			input = i
+		}
+	}
+	if input < 0 {
+		return status, fmt.Errorf("missing column '%s' in CSV header", field)
+	}
+	output := column(out)
+	errColumn := column("error")
+	if err := cw.Write(header); err != nil {
+		return status, err
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return status, nil
+		}
+		if err != nil {
+			return status, err
+		}
+		for len(record) < len(header) {
+			record = append(record, "")
+		}
+		record[output], record[errColumn] = "", ""
+		if id := strings.TrimSpace(record[input]); id != "" {
+			result, err := convert(id)
+			if err != nil {
+				record[errColumn] = err.Error()
+				status.fail(err)
+			}
+			record[output] = result
+		}
+		if err := cw.Write(record); err != nil {
+			return status, err
+		}
+	}
+}
+
+// batchJSONL converts the field of every JSON object, one per line, and
+// sets the out or error field. Other fields are kept as they are.
+func batchJSONL(in io.Reader, w io.Writer, convert converter, field, out string) (exitStatus, error) {
+	var status exitStatus
+	scanner := bufio.NewScanner(in)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var record map[string]json.RawMessage
+		var id string
+		err := json.Unmarshal([]byte(line), &record)
+		if err == nil {
+			if raw, ok := record[field]; !ok || json.Unmarshal(raw, &id) != nil {
+				err = fmt.Errorf("missing string field '%s'", field)
+			}
+		} else {
+			err = fmt.Errorf("invalid JSON: %w", err)
+		}
+		if record == nil {
+			record = map[string]json.RawMessage{}
+		}
+		delete(record, out)
+		delete(record, "error")
+
+		var result string
+		if err == nil {
+			result, err = convert(id)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", n, err)
+			status.fail(err)
+			record["error"], _ = json.Marshal(err.Error())
+		} else {
+			record[out], _ = json.Marshal(result)
+		}
+		if err := enc.Encode(record); err != nil {
+			return status, err
+		}
+	}
+	return status, scanner.Err()
+}
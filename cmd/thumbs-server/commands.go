@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/javadalmasi/Thumbs/internal/paths"
+)
+
+// Exit codes of the subcommands. Configuration errors are fatal and exit
+// with 1 while the config is loaded.
+const (
+	exitOK      = 0
+	exitConfig  = 1
+	exitUsage   = 2
+	exitInvalid = 3
+	exitExpired = 4
+)
+
+type command struct {
+	run     func(args []string) int
+	summary string
+}
+
+var commands = map[string]command{
+	"serve":   {runServe, "Run the proxy server (default)"},
+	"encode":  {runEncode, "Encode video IDs"},
+	"decode":  {runDecode, "Decode encoded IDs"},
+	"batch":   {runBatch, "Encode or decode IDs from stdin or files, as lines, CSV or JSONL"},
+	"sign":    {runSign, "Sign processing URLs"},
+	"encrypt": {runEncrypt, "Encrypt processing parameters into an instruction blob"},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: thumbs-server [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-9s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'thumbs-server <command> -h' for the flags of a command.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Exit codes:")
+	fmt.Fprintln(w, "  0  success")
+	fmt.Fprintln(w, "  1  configuration error")
+	fmt.Fprintln(w, "  2  usage error or unreadable input")
+	fmt.Fprintln(w, "  3  at least one ID was invalid")
+	fmt.Fprintln(w, "  4  at least one ID had expired, none were invalid")
+}
+
+// converter turns one ID into another, an encoded ID into a video ID or
+// the other way around.
+type converter func(string) (string, error)
+
+func encoder(expires string, expiresIn string) (converter, error) {
+	expiry, err := paths.ParseExpiry(expires, expiresIn)
+	if err != nil {
+		return nil, err
+	}
+	return func(videoId string) (string, error) {
+		if expiry.IsZero() {
+			return paths.EncodeID(videoId)
+		}
+		return paths.EncodeExpiringID(videoId, expiry)
+	}, nil
+}
+
+func decoder(allowExpired bool) converter {
+	return func(id string) (string, error) {
+		videoId, expires, err := paths.DecodeID(id)
+		if errors.Is(err, paths.ErrExpired) {
+			if allowExpired {
+				return videoId, nil
+			}
+			return "", fmt.Errorf("%w at %s", err, expires.UTC().Format("2006-01-02T15:04:05Z"))
+		}
+		return videoId, err
+	}
+}
+
+// exitStatus keeps the most severe exit code seen while converting IDs.
+type exitStatus int
+
+func (s *exitStatus) fail(err error) {
+	code := exitStatus(exitInvalid)
+	if errors.Is(err, paths.ErrExpired) {
+		code = exitExpired
+	}
+	s.merge(code)
+}
+
+// merge keeps the more severe of two exit codes.
+func (s *exitStatus) merge(code exitStatus) {
+	if *s == exitOK || (*s == exitExpired && code == exitInvalid) {
+		*s = code
+	}
+}
+
+// convertArgs converts every argument and prints one result per line.
+func convertArgs(convert converter, args []string) int {
+	var status exitStatus
+	for _, arg := range args {
+		result, err := convert(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", arg, err)
+			status.fail(err)
+			continue
+		}
+		fmt.Println(result)
+	}
+	return int(status)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// runDecode implements `thumbs-server decode [flags] ID...`, printing one
+// video ID per line.
+func runDecode(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	allowExpired := fs.Bool("allow-expired", false, "Decode expiring IDs even after they have expired")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: thumbs-server decode [flags] ID...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	return convertArgs(decoder(*allowExpired), fs.Args())
+}
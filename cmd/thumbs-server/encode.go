@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runEncode implements `thumbs-server encode [flags] VIDEO_ID...`, printing
+// one encoded ID per line.
+func runEncode(args []string) int {
+	fs := flag.NewFlagSet("encode", flag.ExitOnError)
+	expires := fs.String("expires", "", "Unix timestamp after which the encoded IDs stop working")
+	expiresIn := fs.String("expires-in", "", "Lifetime of the encoded IDs, in seconds or as a duration like 24h")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: thumbs-server encode [flags] VIDEO_ID...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	convert, err := encoder(*expires, *expiresIn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	return convertArgs(convert, fs.Args())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/javadalmasi/Thumbs/internal/paths"
+)
+
+// runEncrypt implements `thumbs-server encrypt [flags] QUERY...`, printing
+// one instruction blob, or /vi/{id}/e/{blob} path with -id, per line.
+// Blobs only work for the video they were made for, given with -id or
+// -video-id.
+func runEncrypt(args []string) int {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	id := fs.String("id", "", "Encoded ID the blobs are for, prints a full /vi/{id}/e/{blob} path")
+	videoId := fs.String("video-id", "", "Decoded video ID the blobs are for, if -id is not given")
+	expires := fs.String("expires", "", "Unix timestamp after which the blobs stop working")
+	expiresIn := fs.String("expires-in", "", "Lifetime of the blobs, in seconds or as a duration like 24h")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: thumbs-server encrypt [flags] QUERY...")
+		fmt.Fprintln(fs.Output(), "Example: thumbs-server encrypt -id ENCODED_ID 'width=320&format=jpg'")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || (*id == "") == (*videoId == "") {
+		fs.Usage()
+		return exitUsage
+	}
+	expiry, err := paths.ParseExpiry(*expires, *expiresIn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var status exitStatus
+	if *id != "" {
+		if *videoId, _, err = paths.DecodeID(*id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *id, err)
+			status.fail(err)
+			return int(status)
+		}
+	}
+	for _, query := range fs.Args() {
+		blob, err := paths.EncryptInstructions(*videoId, query, expiry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", query, err)
+			status.fail(err)
+			continue
+		}
+		if *id != "" {
+			fmt.Println("/vi/" + *id + "/e/" + blob)
+		} else {
+			fmt.Println(blob)
+		}
+	}
+	return int(status)
+}
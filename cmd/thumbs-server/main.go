@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/subtle"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -11,10 +13,20 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/javadalmasi/Thumbs/internal/availability"
+	"github.com/javadalmasi/Thumbs/internal/blocklist"
+	"github.com/javadalmasi/Thumbs/internal/cache"
 	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/cors"
+	"github.com/javadalmasi/Thumbs/internal/hotlink"
 	"github.com/javadalmasi/Thumbs/internal/httpc"
 	"github.com/javadalmasi/Thumbs/internal/paths"
+	"github.com/javadalmasi/Thumbs/internal/peers"
+	"github.com/javadalmasi/Thumbs/internal/ratelimit"
+	"github.com/javadalmasi/Thumbs/internal/upgrade"
 	"github.com/javadalmasi/Thumbs/internal/utils"
+	"github.com/javadalmasi/Thumbs/internal/watermark"
+	"github.com/javadalmasi/Thumbs/internal/workers"
 	"github.com/prometheus/procfs"
 )
 
@@ -29,6 +41,12 @@ var version string
 var cw ConnectionWatcher
 var tx uint64
 
+// Timeouts of the main and the admin server
+const (
+	readTimeout  = 5 * time.Second
+	writeTimeout = 1 * time.Hour
+)
+
 // https://stackoverflow.com/questions/51317122/how-to-get-number-of-idle-and-active-connections-in-go
 // OnStateChange records open connections in response to connection
 // state changes. Set net/http Server.ConnState to this method
@@ -95,6 +113,9 @@ func blockChecker(gh string, cooldown int) {
 func beforeMisc(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		defer utils.PanicHandler(w)
+		if cors.Apply(w, req) {
+			return
+		}
 		next(w, req)
 	}
 }
@@ -103,14 +124,9 @@ func beforeProxy(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		defer utils.PanicHandler(w)
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-		w.Header().Set("Access-Control-Max-Age", "1728000")
 		w.Header().Set("Strict-Transport-Security", "max-age=86400")
 
-		if req.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+		if cors.Apply(w, req) {
 			return
 		}
 
@@ -120,6 +136,42 @@ func beforeProxy(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		if !hotlink.Allowed(req) {
+			hotlink.Reject(w)
+			return
+		}
+		hotlink.Vary(w.Header())
+
+		next(w, req)
+	}
+}
+
+func beforeAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		defer utils.PanicHandler(w)
+
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Cfg.Admin.Token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "Unauthorized")
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+func beforePeer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		defer utils.PanicHandler(w)
+
+		token := req.Header.Get(peers.TokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Cfg.Peers.Token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "Unauthorized")
+			return
+		}
+
 		next(w, req)
 	}
 }
@@ -129,6 +181,26 @@ func init() {
 }
 
 func main() {
+	// Without a command, or with only flags, the server is started
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	os.Exit(cmd.run(args))
+}
+
+// runServe implements `thumbs-server [serve] [flags]`.
+func runServe(args []string) int {
 	flag.BoolVar(&config.Cfg.Enable_http, "http", config.Cfg.Enable_http, "Enable HTTP Server")
 	flag.BoolVar(&config.Cfg.Uds, "uds", config.Cfg.Uds, "Enable UDS (Unix socket domain)")
 	flag.IntVar(&config.Cfg.Http_client_ver, "http-client-ver", config.Cfg.Http_client_ver, "Specify the HTTP Version that is going to be used on the client, accepted values are '1', '2 'and '3'")
@@ -137,13 +209,13 @@ func main() {
 	flag.StringVar(&config.Cfg.Proxy, "pr", config.Cfg.Proxy, "Specify the proxy that is going to be used for requests\nExample: http://127.0.0.1:8090")
 	flag.StringVar(&config.Cfg.Port, "p", config.Cfg.Port, "Specify a port number")
 	flag.StringVar(&config.Cfg.Host, "l", config.Cfg.Host, "Specify a listen address")
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	// Set the version for the paths package
 	paths.Version = version
 
 
-	log.Printf("[INFO] Current config values: %+v\n", config.Cfg)
+	log.Printf("[INFO] Current config values: %+v\n", config.Redacted())
 
 	switch config.Cfg.Http_client_ver {
 	case 1:
@@ -160,19 +232,83 @@ func main() {
 		httpc.Client = httpc.H1_1client
 	}
 
+	cors.Start()
+	hotlink.Start()
+
 	mux := http.NewServeMux()
 
 	// PROXY ROUTES
 	mux.HandleFunc("/vi/", beforeProxy(paths.Vi))
+	for _, route := range config.Cfg.Id_policy.Route_list {
+		mux.HandleFunc(route.Prefix, beforeProxy(paths.ViRoute(route.Prefix, route.Policy)))
+	}
+
+	if config.Cfg.Availability.Enabled {
+		availability.Start()
+	}
+
+	if config.Cfg.Cache.Enabled {
+		cache.Start()
+	}
+
+	// PEER ROUTES
+	if config.Cfg.Peers.List != "" || config.Cfg.Peers.Srv != "" {
+		mux.HandleFunc("/_peer/vi/", beforePeer(paths.PeerVi))
+		mux.HandleFunc("/_peer/purge", beforePeer(paths.PeerPurge))
+		peers.Start()
+	}
+
+	// ADMIN ROUTES
+	if config.Cfg.Admin.Token != "" {
+		prefix := config.Cfg.Admin.Prefix
+		admin := beforeAdmin(paths.Admin(prefix))
+		if config.Cfg.Admin.Listen != "" {
+			adminMux := http.NewServeMux()
+			adminMux.HandleFunc(prefix, admin)
+			adminSrv := &http.Server{
+				Handler:      adminMux,
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				Addr:         config.Cfg.Admin.Listen,
+			}
+			go func() {
+				log.Println("[INFO] Serving admin API at", config.Cfg.Admin.Listen+prefix)
+				if err := adminSrv.ListenAndServe(); err != nil {
+					log.Printf("[ERROR] Failed to listen on '%s' for the admin API: %s\n", config.Cfg.Admin.Listen, err)
+				}
+			}()
+		} else {
+			mux.HandleFunc(prefix, admin)
+		}
+	}
 
 	if config.Cfg.Gluetun.Block_checker {
 		go blockChecker(config.Cfg.Gluetun.Gluetun_api, config.Cfg.Gluetun.Block_checker_cooldown)
 	}
 
+	workers.Start()
+
+	if config.Cfg.Rate_limit.Enabled {
+		ratelimit.Start()
+	}
+
+	if config.Cfg.Blocklist.Path != "" {
+		blocklist.Start(func(videoId string) { paths.Purge(videoId) })
+	}
+
+	if config.Cfg.Watermark.Dir != "" {
+		watermark.Start(paths.PurgeWatermark)
+	}
+
+	if config.Cfg.Upgrade.Enabled {
+		upgrade.AddPurgeHook(func(videoId string) { paths.Purge(videoId) })
+		upgrade.Start(paths.ProbeMaxres)
+	}
+
 	srv := &http.Server{
 		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 1 * time.Hour,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
 		ConnState:    cw.OnStateChange,
 		Addr:         config.Cfg.Host + ":" + config.Cfg.Port,
 	}
@@ -187,13 +323,25 @@ func main() {
 		err = os.Chmod(config.Cfg.Uds_path, 0777)
 		if err != nil {
 			log.Println("[ERROR] Failed to set socket permissions to 777:", err.Error())
-			return
+			return exitOK
 		} else {
 			log.Println("[INFO] Setting socket permissions to 777")
 		}
 
+		// The UDS listener may use its own ID policy, e.g. raw IDs for
+		// internal services only
+		socket_srv := srv
+		if config.Cfg.Id_policy.Uds != "" {
+			socket_srv = &http.Server{
+				Handler:      paths.WithIDPolicy(mux, config.Cfg.Id_policy.Uds),
+				ReadTimeout:  srv.ReadTimeout,
+				WriteTimeout: srv.WriteTimeout,
+				ConnState:    srv.ConnState,
+			}
+		}
+
 		go func() {
-			err := srv.Serve(socket_listener)
+			err := socket_srv.Serve(socket_listener)
 			if err != nil {
 				log.Println("[ERROR] Failed to listen serve UDS:", err)
 			}
@@ -209,4 +357,5 @@ func main() {
 			log.Fatalf("[FATAL] Failed to listen on '%s:%s': %s\n", config.Cfg.Host, config.Cfg.Port, err)
 		}
 	}
+	return exitOK
 }
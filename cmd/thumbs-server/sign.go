@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/paths"
+)
+
+// runSign implements `thumbs-server sign [flags] URL...`, printing one
+// signed path and query per line.
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	expires := fs.String("expires", "", "Unix timestamp after which the signed URLs stop working")
+	expiresIn := fs.String("expires-in", "", "Lifetime of the signed URLs, in seconds or as a duration like 24h")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: thumbs-server sign [flags] URL...")
+		fmt.Fprintln(fs.Output(), "Example: thumbs-server sign '/vi/ENCODED_ID?width=320&format=jpg'")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if config.Cfg.Signing.Key == "" {
+		fmt.Fprintln(os.Stderr, "URL_SIGNING_KEY is not set")
+		return exitUsage
+	}
+
+	expiry, err := paths.ParseExpiry(*expires, *expiresIn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var status exitStatus
+	for _, rawURL := range fs.Args() {
+		signed, err := paths.SignURL(rawURL, expiry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", rawURL, err)
+			status.fail(err)
+			continue
+		}
+		fmt.Println(signed)
+	}
+	return int(status)
+}
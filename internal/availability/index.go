@@ -0,0 +1,217 @@
+// Package availability remembers which thumbnail renditions exist for a
+// video, so the quality ladder does not pay for the same 404s on every
+// cold request.
+package availability
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+	"github.com/javadalmasi/Thumbs/internal/utils"
+)
+
+// Record is what we last learned about one rendition of a video.
+type Record struct {
+	Exists  bool      `json:"exists"`
+	Checked time.Time `json:"checked"`
+}
+
+// Index maps video IDs to the renditions we know about.
+type Index struct {
+	mu          sync.RWMutex
+	path        string
+	maxEntries  int
+	negativeTTL time.Duration
+	dirty       bool
+	entries     map[string]map[string]Record
+}
+
+var index *Index
+
+func NewIndex(path string, maxEntries int, negativeTTL time.Duration) *Index {
+	return &Index{
+		path:        path,
+		maxEntries:  maxEntries,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]map[string]Record),
+	}
+}
+
+// Start creates the process wide index, loads it from disk if persistence
+// is configured and periodically saves it back.
+func Start() {
+	c := config.Cfg.Availability
+	i := NewIndex(c.Path, c.Max_entries, time.Duration(c.Negative_ttl)*time.Second)
+	if i.path != "" {
+		if err := i.Load(); err != nil {
+			log.Printf("[ERROR] [availability] Failed to load index from '%s': %s\n", i.path, err)
+		}
+		go func() {
+			for {
+				time.Sleep(time.Duration(c.Save_interval) * time.Second)
+				if err := i.Save(); err != nil {
+					log.Printf("[ERROR] [availability] Failed to save index: %s\n", err)
+				}
+			}
+		}()
+	}
+	index = i
+
+	metrics.Gauge("availability_index_size", func() any { return i.Len() })
+	metrics.Gauge("availability_hit_rate", func() any {
+		return metrics.Ratio("availability_hits", "availability_misses")
+	})
+	log.Printf("[INFO] Availability index started with %d videos\n", i.Len())
+}
+
+// Missing reports whether a rendition is known not to exist and the
+// negative entry has not expired yet. It is always false when the index
+// is disabled.
+func Missing(videoId, rendition string) bool {
+	if index == nil {
+		return false
+	}
+	return index.Missing(videoId, rendition)
+}
+
+// Set records whether a rendition exists.
+func Set(videoId, rendition string, exists bool) {
+	if index == nil {
+		return
+	}
+	index.Set(videoId, rendition, exists)
+}
+
+// Forget drops everything known about a video.
+func Forget(videoId string) {
+	if index == nil {
+		return
+	}
+	index.Forget(videoId)
+}
+
+// Len returns the number of videos in the index.
+func Len() int {
+	if index == nil {
+		return 0
+	}
+	return index.Len()
+}
+
+func (i *Index) Missing(videoId, rendition string) bool {
+	i.mu.RLock()
+	r, ok := i.entries[videoId][rendition]
+	i.mu.RUnlock()
+
+	if !ok || (!r.Exists && time.Since(r.Checked) > i.negativeTTL) {
+		metrics.Inc("availability_misses")
+		return false
+	}
+	metrics.Inc("availability_hits")
+	if !r.Exists {
+		metrics.Inc("availability_skipped")
+	}
+	return !r.Exists
+}
+
+func (i *Index) Set(videoId, rendition string, exists bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	renditions, ok := i.entries[videoId]
+	if !ok {
+		if len(i.entries) >= i.maxEntries {
+			i.evict()
+		}
+		renditions = make(map[string]Record)
+		i.entries[videoId] = renditions
+	}
+	renditions[rendition] = Record{Exists: exists, Checked: time.Now()}
+	i.dirty = true
+}
+
+func (i *Index) Forget(videoId string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.entries[videoId]; ok {
+		delete(i.entries, videoId)
+		i.dirty = true
+	}
+}
+
+// evict makes room for one more video. Videos whose negative entries have
+// all expired go first; otherwise an arbitrary video is dropped.
+// Must be called with the lock held.
+func (i *Index) evict() {
+	var victim string
+	for videoId, renditions := range i.entries {
+		victim = videoId
+		stale := true
+		for _, r := range renditions {
+			if r.Exists || time.Since(r.Checked) <= i.negativeTTL {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			break
+		}
+	}
+	delete(i.entries, victim)
+}
+
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.entries)
+}
+
+// Load reads the index from disk. A missing file is not an error.
+func (i *Index) Load() error {
+	data, err := os.ReadFile(i.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]map[string]Record)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for videoId, renditions := range entries {
+		if len(i.entries) >= i.maxEntries {
+			break
+		}
+		i.entries[videoId] = renditions
+	}
+	return nil
+}
+
+// Save writes the index to disk if it changed since the last save.
+func (i *Index) Save() error {
+	i.mu.Lock()
+	if !i.dirty {
+		i.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(i.entries)
+	i.dirty = false
+	i.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(i.path, data)
+}
@@ -0,0 +1,162 @@
+// Package blocklist stops serving thumbnails of specific videos, for
+// example after a legal takedown request. The list of decoded video IDs is
+// read from a file and reloaded when the file changes or on SIGHUP. In
+// allowlist mode only the listed videos are served.
+package blocklist
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/cache"
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// PurgeHook is called for every video that becomes blocked, so that
+// cached copies can be invalidated.
+type PurgeHook func(videoId string)
+
+var mu sync.RWMutex
+var ids map[string]bool
+var allow bool
+var hook PurgeHook
+
+// Start loads the list and reloads it whenever the file's modification
+// time or size changes, or the process receives SIGHUP. The hook is
+// called for every video that becomes blocked.
+func Start(h PurgeHook) {
+	c := config.Cfg.Blocklist
+	allow = c.Mode == "allow"
+	hook = h
+	// Nothing is cached yet on the first load, so there is nothing to purge
+	if err := reload(c.Path, false); err != nil {
+		log.Printf("[ERROR] [blocklist] Failed to load '%s': %s\n", c.Path, err)
+		if allow {
+			// Serving nothing is safer than serving everything
+			setIds(map[string]bool{})
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		last, _ := os.Stat(c.Path)
+		ticker := time.NewTicker(time.Duration(c.Reload_interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hup:
+				log.Println("[INFO] [blocklist] Reloading on SIGHUP")
+			case <-ticker.C:
+				info, err := os.Stat(c.Path)
+				if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+					continue
+				}
+				last = info
+			}
+			if err := reload(c.Path, true); err != nil {
+				log.Printf("[ERROR] [blocklist] Failed to reload '%s', keeping the previous list: %s\n", c.Path, err)
+			}
+		}
+	}()
+
+	metrics.Gauge("blocklist_size", func() any {
+		mu.RLock()
+		defer mu.RUnlock()
+		return len(ids)
+	})
+}
+
+// Blocked reports whether a video may not be served. It is always false
+// when the blocklist is disabled.
+func Blocked(videoId string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ids == nil {
+		return false
+	}
+	return ids[videoId] != allow
+}
+
+// load reads one video ID per line. Empty lines and lines starting with
+// '#' are skipped.
+func load(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !validID(line) {
+			log.Printf("[ERROR] [blocklist] Skipping invalid video ID '%s' on line %d\n", line, n)
+			continue
+		}
+		list[line] = true
+	}
+	return list, scanner.Err()
+}
+
+// validID reports whether id looks like a decoded YouTube ID, 11
+// base64url characters, like the IDs the paths package accepts.
+func validID(id string) bool {
+	if len(id) != 11 {
+		return false
+	}
+	for _, c := range id {
+		if !((c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// reload replaces the list and, if purge is set, calls the hook for every
+// video that was served until now.
+func reload(path string, purge bool) error {
+	list, err := load(path)
+	if err != nil {
+		return err
+	}
+	previous := setIds(list)
+	log.Printf("[INFO] [blocklist] Loaded %d video IDs from '%s'\n", len(list), path)
+
+	if !purge || hook == nil {
+		return nil
+	}
+	if allow {
+		for _, videoId := range cache.Videos() {
+			if !list[videoId] {
+				hook(videoId)
+			}
+		}
+		return nil
+	}
+	for videoId := range list {
+		if !previous[videoId] {
+			hook(videoId)
+		}
+	}
+	return nil
+}
+
+func setIds(list map[string]bool) map[string]bool {
+	mu.Lock()
+	defer mu.Unlock()
+	previous := ids
+	ids = list
+	return previous
+}
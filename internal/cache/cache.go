@@ -0,0 +1,283 @@
+// Package cache is an in-memory LRU cache of served thumbnails. Entries
+// are keyed by video ID plus the canonical transform, and indexed by video
+// ID so every variant of a video can be listed or purged at once.
+package cache
+
+import (
+	"container/list"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// Entry is one cached variant of a thumbnail.
+type Entry struct {
+	VideoId   string
+	Transform string
+	Rendition string
+	Processed bool
+	Header    http.Header
+	Body      []byte
+	Created   time.Time
+	Hits      int64
+}
+
+// Variant describes a cached entry without its body.
+type Variant struct {
+	Transform string    `json:"transform"`
+	Rendition string    `json:"rendition"`
+	Size      int       `json:"size"`
+	Created   time.Time `json:"created"`
+	Hits      int64     `json:"hits"`
+}
+
+// Stats is a point in time view of the cache.
+type Stats struct {
+	Entries   int     `json:"entries"`
+	Videos    int     `json:"videos"`
+	Bytes     int64   `json:"bytes"`
+	MaxBytes  int64   `json:"max_bytes"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Evictions int64   `json:"evictions"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+	byVideo  map[string]map[string]struct{}
+}
+
+var store *Cache
+
+func New(maxBytes int64, ttl time.Duration) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		byVideo:  make(map[string]map[string]struct{}),
+	}
+}
+
+// Start creates the process wide cache from the configuration.
+func Start() {
+	c := config.Cfg.Cache
+	store = New(int64(c.Max_size)*1024*1024, time.Duration(c.Ttl)*time.Second)
+
+	metrics.Gauge("cache_entries", func() any { return store.Stats().Entries })
+	metrics.Gauge("cache_bytes", func() any { return store.Stats().Bytes })
+	metrics.Gauge("cache_hit_rate", func() any {
+		return metrics.Ratio("cache_hits", "cache_misses")
+	})
+	log.Printf("[INFO] Cache enabled with %d MB\n", c.Max_size)
+}
+
+// Enabled reports whether the process wide cache is running.
+func Enabled() bool {
+	return store != nil
+}
+
+// Key builds the cache key for a video and canonical transform.
+func Key(videoId, transform string) string {
+	return videoId + "/" + transform
+}
+
+func Get(videoId, transform string) *Entry {
+	if store == nil {
+		return nil
+	}
+	return store.Get(videoId, transform)
+}
+
+func Set(e *Entry) {
+	if store == nil {
+		return
+	}
+	store.Set(e)
+}
+
+// PurgeVideo removes every variant of a video and returns how many
+// entries were removed.
+func PurgeVideo(videoId string) int {
+	if store == nil {
+		return 0
+	}
+	return store.PurgeVideo(videoId)
+}
+
+// PurgeVariant removes a single variant of a video.
+func PurgeVariant(videoId, transform string) int {
+	if store == nil {
+		return 0
+	}
+	return store.PurgeVariant(videoId, transform)
+}
+
+func Variants(videoId string) []Variant {
+	if store == nil {
+		return nil
+	}
+	return store.Variants(videoId)
+}
+
+// Videos returns the IDs of every video with at least one cached variant.
+func Videos() []string {
+	if store == nil {
+		return nil
+	}
+	return store.Videos()
+}
+
+func GetStats() Stats {
+	if store == nil {
+		return Stats{}
+	}
+	return store.Stats()
+}
+
+func (c *Cache) Get(videoId, transform string) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[Key(videoId, transform)]
+	if !ok {
+		metrics.Inc("cache_misses")
+		return nil
+	}
+	e := el.Value.(*Entry)
+	if c.ttl > 0 && time.Since(e.Created) > c.ttl {
+		c.remove(el)
+		metrics.Inc("cache_misses")
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	e.Hits++
+	metrics.Inc("cache_hits")
+	return e
+}
+
+func (c *Cache) Set(e *Entry) {
+	size := int64(len(e.Body))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := Key(e.VideoId, e.Transform)
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if e.Created.IsZero() {
+		e.Created = time.Now()
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += size
+	if c.byVideo[e.VideoId] == nil {
+		c.byVideo[e.VideoId] = make(map[string]struct{})
+	}
+	c.byVideo[e.VideoId][e.Transform] = struct{}{}
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+		metrics.Inc("cache_evictions")
+	}
+}
+
+func (c *Cache) PurgeVideo(videoId string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for transform := range c.byVideo[videoId] {
+		if el, ok := c.items[Key(videoId, transform)]; ok {
+			c.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Cache) PurgeVariant(videoId, transform string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[Key(videoId, transform)]; ok {
+		c.remove(el)
+		return 1
+	}
+	return 0
+}
+
+func (c *Cache) Variants(videoId string) []Variant {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	variants := []Variant{}
+	for transform := range c.byVideo[videoId] {
+		e := c.items[Key(videoId, transform)].Value.(*Entry)
+		variants = append(variants, Variant{
+			Transform: e.Transform,
+			Rendition: e.Rendition,
+			Size:      len(e.Body),
+			Created:   e.Created,
+			Hits:      e.Hits,
+		})
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].Transform < variants[j].Transform
+	})
+	return variants
+}
+
+func (c *Cache) Videos() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	videos := make([]string, 0, len(c.byVideo))
+	for videoId := range c.byVideo {
+		videos = append(videos, videoId)
+	}
+	return videos
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Entries:   len(c.items),
+		Videos:    len(c.byVideo),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+		Hits:      metrics.Get("cache_hits"),
+		Misses:    metrics.Get("cache_misses"),
+		Evictions: metrics.Get("cache_evictions"),
+		HitRate:   metrics.Ratio("cache_hits", "cache_misses"),
+	}
+}
+
+// remove drops an element from every index. Must be called with the lock held.
+func (c *Cache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*Entry)
+	delete(c.items, Key(e.VideoId, e.Transform))
+	c.bytes -= int64(len(e.Body))
+	if transforms, ok := c.byVideo[e.VideoId]; ok {
+		delete(transforms, e.Transform)
+		if len(transforms) == 0 {
+			delete(c.byVideo, e.VideoId)
+		}
+	}
+}
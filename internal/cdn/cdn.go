@@ -0,0 +1,139 @@
+// Package cdn tags responses so CDNs in front of Thumbs can purge them by
+// video, and notifies those CDNs when Thumbs invalidates a video itself.
+package cdn
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+)
+
+// Endpoint is a CDN node that accepts purge requests.
+type Endpoint struct {
+	Method string
+	URL    string
+}
+
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// videoTag returns an opaque tag for a video. Tags are keyed with
+// CDN_TAG_KEY so they do not leak the decoded YouTube ID to clients, and
+// stay the same when SECRET_KEY is rotated, so purges keep reaching
+// responses the CDN already holds.
+func videoTag(videoId string) string {
+	mac := hmac.New(sha256.New, []byte(config.Cfg.Cdn.Tag_key))
+	mac.Write([]byte(videoId))
+	return "vi_" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// variantTag returns the tag of one variant of a video, identified by its
+// canonical transform.
+func variantTag(videoId, transform string) string {
+	sum := sha256.Sum256([]byte(transform))
+	return videoTag(videoId) + "_t" + hex.EncodeToString(sum[:])[:8]
+}
+
+// WatermarkTag returns the tag of the responses that carry a watermark
+// image.
+func WatermarkTag(name string) string {
+	mac := hmac.New(sha256.New, []byte(config.Cfg.Cdn.Tag_key))
+	mac.Write([]byte(name))
+	return "wm_" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Tags returns the cache tags of a response: one for the video, one for
+// the variant and one for the video plus the rendition it was served from,
+// followed by any extra tags.
+func Tags(videoId, rendition, transform string, extra ...string) []string {
+	tag := videoTag(videoId)
+	tags := []string{tag, variantTag(videoId, transform)}
+	rendition = strings.TrimSuffix(rendition, ".jpg")
+	if rendition != "" {
+		tags = append(tags, tag+"_"+rendition)
+	}
+	return append(tags, extra...)
+}
+
+// SetHeaders adds the LiteSpeed, Varnish/Fastly and Cloudflare style tag
+// headers to a response.
+func SetHeaders(h http.Header, videoId, rendition, transform string, extra ...string) {
+	tags := Tags(videoId, rendition, transform, extra...)
+	h.Set("X-LiteSpeed-Tag", strings.Join(tags, ","))
+	h.Set("Surrogate-Key", strings.Join(tags, " "))
+	h.Set("Cache-Tag", strings.Join(tags, ","))
+}
+
+// ParseEndpoints reads a comma separated list of "METHOD URL" pairs, for
+// example "PURGE http://127.0.0.1:6081/,BAN http://127.0.0.1:6082/".
+// A bare URL defaults to PURGE.
+func ParseEndpoints(s string) []Endpoint {
+	var endpoints []Endpoint
+	for _, item := range strings.Split(s, ",") {
+		fields := strings.Fields(item)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			endpoints = append(endpoints, Endpoint{Method: "PURGE", URL: fields[0]})
+		default:
+			endpoints = append(endpoints, Endpoint{Method: strings.ToUpper(fields[0]), URL: fields[1]})
+		}
+	}
+	return endpoints
+}
+
+// Notify asks every configured CDN endpoint to drop all responses tagged
+// with the video. Requests are sent in the background.
+func Notify(videoId string) {
+	notify(videoTag(videoId))
+}
+
+// NotifyVariant asks every configured CDN endpoint to drop the responses
+// of one variant of the video.
+func NotifyVariant(videoId, transform string) {
+	notify(variantTag(videoId, transform))
+}
+
+// NotifyWatermark asks every configured CDN endpoint to drop the
+// responses that carry a watermark image.
+func NotifyWatermark(name string) {
+	notify(WatermarkTag(name))
+}
+
+func notify(tag string) {
+	endpoints := ParseEndpoints(config.Cfg.Cdn.Purge_endpoints)
+	if len(endpoints) == 0 {
+		return
+	}
+
+	for _, e := range endpoints {
+		go func(e Endpoint) {
+			request, err := http.NewRequest(e.Method, e.URL, nil)
+			if err != nil {
+				log.Printf("[ERROR] [cdn] Invalid purge endpoint '%s %s': %s\n", e.Method, e.URL, err)
+				return
+			}
+			request.Header.Set("X-LiteSpeed-Purge", "tag="+tag)
+			request.Header.Set("Surrogate-Key", tag)
+			request.Header.Set("Cache-Tag", tag)
+
+			resp, err := client.Do(request)
+			if err != nil {
+				log.Printf("[ERROR] [cdn] Failed to send %s to '%s': %s\n", e.Method, e.URL, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("[ERROR] [cdn] %s to '%s' returned status %d\n", e.Method, e.URL, resp.StatusCode)
+			}
+		}(e)
+	}
+}
@@ -2,6 +2,9 @@ package config
 
 import (
 	"log"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -11,6 +14,19 @@ import (
 
 var Cfg *config
 
+// Key is one entry of the secret keyring.
+type Key struct {
+	Id     string
+	Secret string
+}
+
+// IdRoute serves /vi/ below an additional path prefix with its own ID
+// policy.
+type IdRoute struct {
+	Prefix string
+	Policy string
+}
+
 type config struct {
 	Enable_http     bool
 	Uds             bool
@@ -26,9 +42,128 @@ type config struct {
 		Block_checker_cooldown int
 	}
 	Companion struct {
-		Secret_key string
+		Secret_key     string
+		Secret_key_id  string
+		Secondary_keys string
+		V1_key_id      string
+		Allow_v1_ids   bool
+		// Keys is parsed from the values above by checkConfig, the
+		// primary key always comes first.
+		Keys []Key
 	}
 	Enable_litespeed_cache bool
+	Upgrade                struct {
+		Enabled      bool
+		Queue_path   string
+		Queue_size   int
+		Interval     int
+		Concurrency  int
+		Backoff      int
+		Max_attempts int
+	}
+	Availability struct {
+		Enabled       bool
+		Path          string
+		Max_entries   int
+		Negative_ttl  int
+		Save_interval int
+	}
+	Cache struct {
+		Enabled  bool
+		Max_size int
+		Ttl      int
+	}
+	Admin struct {
+		Token  string
+		Prefix string
+		Listen string
+	}
+	Cdn struct {
+		Enable_tags     bool
+		Purge_endpoints string
+		Tag_key         string
+	}
+	Peers struct {
+		Self          string
+		List          string
+		Srv           string
+		Token         string
+		Vnodes        int
+		Refresh       int
+		Hot_threshold int
+	}
+	Signing struct {
+		Key     string
+		Enforce bool
+	}
+	Id_policy struct {
+		Default string
+		Uds     string
+		Routes  string
+		// Route_list is parsed from Routes by checkConfig.
+		Route_list []IdRoute
+	}
+	Blocklist struct {
+		Path            string
+		Mode            string
+		Reload_interval int
+	}
+	Rate_limit struct {
+		Enabled         bool
+		Hit_rate        float64
+		Hit_burst       int
+		Miss_rate       float64
+		Miss_burst      int
+		Process_weight  float64
+		Trusted_proxies string
+	}
+	Hotlink struct {
+		Allow       string
+		Deny        string
+		Allow_empty bool
+		Placeholder string
+	}
+	Cors struct {
+		Origins     string
+		Methods     string
+		Headers     string
+		Expose      string
+		Credentials bool
+		Max_age     int
+	}
+	Limits struct {
+		Max_body          int64
+		Max_source_pixels int64
+		Max_width         int
+		Max_height        int
+		Max_output_pixels int64
+		Max_dpr           float64
+	}
+	Processing struct {
+		Workers      int
+		Queue_size   int
+		Max_wait     int
+		Small_pixels int
+	}
+	Client_hints struct {
+		Enabled           bool
+		Breakpoints       string
+		Save_data_quality int
+		// Breakpoint_list is parsed from Breakpoints by checkConfig.
+		Breakpoint_list []int
+	}
+	Max_bytes struct {
+		Min_quality int
+		Downscales  int
+	}
+	Palette struct {
+		Colors int
+		Dither bool
+	}
+	Watermark struct {
+		Dir            string
+		Check_interval int
+	}
 }
 
 func getenv(key string) string {
@@ -69,6 +204,18 @@ func getEnvInt(key string, def int) int {
 	return int(i)
 }
 
+func getEnvFloat(key string, def float64) float64 {
+	v := strings.ToLower(getenv(key))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Panicf("[FATAL] Failed to convert env variable '%s' to float", v)
+	}
+	return f
+}
+
 func LoadConfig() {
 	// Load .env file if it exists
 	_ = godotenv.Load()
@@ -93,16 +240,420 @@ func LoadConfig() {
 			Block_checker:          getEnvBool("BLOCK_CHECKER", true),
 			Block_checker_cooldown: getEnvInt("BLOCK_CHECKER_COOLDOWN", 60),
 		},
-		Companion: struct{ Secret_key string }{
-			Secret_key: getEnvString("SECRET_KEY", "", false),
+		Companion: struct {
+			Secret_key     string
+			Secret_key_id  string
+			Secondary_keys string
+			V1_key_id      string
+			Allow_v1_ids   bool
+			Keys           []Key
+		}{
+			Secret_key:     getEnvString("SECRET_KEY", "", false),
+			Secret_key_id:  getEnvString("SECRET_KEY_ID", "primary", false),
+			Secondary_keys: getEnvString("SECONDARY_SECRET_KEYS", "", false),
+			V1_key_id:      getEnvString("V1_SECRET_KEY_ID", "", false),
+			Allow_v1_ids:   getEnvBool("ALLOW_V1_IDS", true),
 		},
 		Enable_litespeed_cache: getEnvBool("ENABLE_LITESPEED_CACHE", false),
+		Upgrade: struct {
+			Enabled      bool
+			Queue_path   string
+			Queue_size   int
+			Interval     int
+			Concurrency  int
+			Backoff      int
+			Max_attempts int
+		}{
+			Enabled:      getEnvBool("ENABLE_UPGRADE_WORKER", false),
+			Queue_path:   getEnvString("UPGRADE_QUEUE_PATH", "/tmp/thumbs-upgrade-queue.json", false),
+			Queue_size:   getEnvInt("UPGRADE_QUEUE_SIZE", 10000),
+			Interval:     getEnvInt("UPGRADE_INTERVAL", 300),
+			Concurrency:  getEnvInt("UPGRADE_CONCURRENCY", 4),
+			Backoff:      getEnvInt("UPGRADE_BACKOFF", 3600),
+			Max_attempts: getEnvInt("UPGRADE_MAX_ATTEMPTS", 10),
+		},
+		Availability: struct {
+			Enabled       bool
+			Path          string
+			Max_entries   int
+			Negative_ttl  int
+			Save_interval int
+		}{
+			Enabled:       getEnvBool("ENABLE_AVAILABILITY_INDEX", true),
+			Path:          getEnvString("AVAILABILITY_INDEX_PATH", "", false),
+			Max_entries:   getEnvInt("AVAILABILITY_MAX_ENTRIES", 100000),
+			Negative_ttl:  getEnvInt("AVAILABILITY_NEGATIVE_TTL", 86400),
+			Save_interval: getEnvInt("AVAILABILITY_SAVE_INTERVAL", 60),
+		},
+		Cache: struct {
+			Enabled  bool
+			Max_size int
+			Ttl      int
+		}{
+			Enabled:  getEnvBool("ENABLE_CACHE", false),
+			Max_size: getEnvInt("CACHE_MAX_SIZE", 256),
+			Ttl:      getEnvInt("CACHE_TTL", 86400),
+		},
+		Admin: struct {
+			Token  string
+			Prefix string
+			Listen string
+		}{
+			Token:  getEnvString("ADMIN_TOKEN", "", false),
+			Prefix: getEnvString("ADMIN_PREFIX", "/admin/", false),
+			Listen: getEnvString("ADMIN_LISTEN", "", false),
+		},
+		Cdn: struct {
+			Enable_tags     bool
+			Purge_endpoints string
+			Tag_key         string
+		}{
+			Enable_tags:     getEnvBool("ENABLE_CACHE_TAGS", false),
+			Purge_endpoints: getEnvString("CDN_PURGE_ENDPOINTS", "", false),
+			Tag_key:         getEnvString("CDN_TAG_KEY", "", false),
+		},
+		Peers: struct {
+			Self          string
+			List          string
+			Srv           string
+			Token         string
+			Vnodes        int
+			Refresh       int
+			Hot_threshold int
+		}{
+			Self:          getEnvString("PEER_SELF", "", false),
+			List:          getEnvString("PEERS", "", false),
+			Srv:           getEnvString("PEER_SRV", "", false),
+			Token:         getEnvString("PEER_TOKEN", "", false),
+			Vnodes:        getEnvInt("PEER_VNODES", 50),
+			Refresh:       getEnvInt("PEER_REFRESH", 30),
+			Hot_threshold: getEnvInt("PEER_HOT_THRESHOLD", 10),
+		},
+		Signing: struct {
+			Key     string
+			Enforce bool
+		}{
+			Key:     getEnvString("URL_SIGNING_KEY", "", false),
+			Enforce: getEnvBool("ENFORCE_URL_SIGNING", false),
+		},
+		Id_policy: struct {
+			Default    string
+			Uds        string
+			Routes     string
+			Route_list []IdRoute
+		}{
+			Default: getEnvString("ID_POLICY", "encoded", true),
+			Uds:     getEnvString("UDS_ID_POLICY", "", true),
+			Routes:  getEnvString("ID_POLICY_ROUTES", "", false),
+		},
+		Blocklist: struct {
+			Path            string
+			Mode            string
+			Reload_interval int
+		}{
+			Path:            getEnvString("BLOCKLIST_PATH", "", false),
+			Mode:            getEnvString("BLOCKLIST_MODE", "block", false),
+			Reload_interval: getEnvInt("BLOCKLIST_RELOAD_INTERVAL", 10),
+		},
+		Rate_limit: struct {
+			Enabled         bool
+			Hit_rate        float64
+			Hit_burst       int
+			Miss_rate       float64
+			Miss_burst      int
+			Process_weight  float64
+			Trusted_proxies string
+		}{
+			Enabled:         getEnvBool("ENABLE_RATE_LIMIT", false),
+			Hit_rate:        getEnvFloat("RATE_LIMIT_HIT_RATE", 50),
+			Hit_burst:       getEnvInt("RATE_LIMIT_HIT_BURST", 100),
+			Miss_rate:       getEnvFloat("RATE_LIMIT_MISS_RATE", 5),
+			Miss_burst:      getEnvInt("RATE_LIMIT_MISS_BURST", 20),
+			Process_weight:  getEnvFloat("RATE_LIMIT_PROCESS_WEIGHT", 4),
+			Trusted_proxies: getEnvString("TRUSTED_PROXIES", "", false),
+		},
+		Hotlink: struct {
+			Allow       string
+			Deny        string
+			Allow_empty bool
+			Placeholder string
+		}{
+			Allow:       getEnvString("REFERER_ALLOW", "", false),
+			Deny:        getEnvString("REFERER_DENY", "", false),
+			Allow_empty: getEnvBool("REFERER_ALLOW_EMPTY", true),
+			Placeholder: getEnvString("REFERER_PLACEHOLDER", "", false),
+		},
+		Cors: struct {
+			Origins     string
+			Methods     string
+			Headers     string
+			Expose      string
+			Credentials bool
+			Max_age     int
+		}{
+			Origins:     getEnvString("CORS_ALLOW_ORIGINS", "*", false),
+			Methods:     getEnvString("CORS_ALLOW_METHODS", "GET, HEAD, OPTIONS", false),
+			Headers:     getEnvString("CORS_ALLOW_HEADERS", "*", false),
+			Expose:      getEnvString("CORS_EXPOSE_HEADERS", "", false),
+			Credentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+			Max_age:     getEnvInt("CORS_MAX_AGE", 86400),
+		},
+		Limits: struct {
+			Max_body          int64
+			Max_source_pixels int64
+			Max_width         int
+			Max_height        int
+			Max_output_pixels int64
+			Max_dpr           float64
+		}{
+			Max_body:          int64(getEnvInt("MAX_UPSTREAM_BODY", 10*1024*1024)),
+			Max_source_pixels: int64(getEnvInt("MAX_SOURCE_PIXELS", 25000000)),
+			Max_width:         getEnvInt("MAX_OUTPUT_WIDTH", 4096),
+			Max_height:        getEnvInt("MAX_OUTPUT_HEIGHT", 4096),
+			Max_output_pixels: int64(getEnvInt("MAX_OUTPUT_PIXELS", 16777216)),
+			Max_dpr:           getEnvFloat("MAX_DPR", 3),
+		},
+		Processing: struct {
+			Workers      int
+			Queue_size   int
+			Max_wait     int
+			Small_pixels int
+		}{
+			Workers:      getEnvInt("PROCESSING_WORKERS", 0),
+			Queue_size:   getEnvInt("PROCESSING_QUEUE_SIZE", 64),
+			Max_wait:     getEnvInt("PROCESSING_MAX_WAIT", 2000),
+			Small_pixels: getEnvInt("PROCESSING_SMALL_PIXELS", 320*180),
+		},
+		Client_hints: struct {
+			Enabled           bool
+			Breakpoints       string
+			Save_data_quality int
+			Breakpoint_list   []int
+		}{
+			Enabled:           getEnvBool("ENABLE_CLIENT_HINTS", true),
+			Breakpoints:       getEnvString("CLIENT_HINTS_BREAKPOINTS", "160,320,480,640,960,1280", false),
+			Save_data_quality: getEnvInt("SAVE_DATA_QUALITY", 50),
+		},
+		Max_bytes: struct {
+			Min_quality int
+			Downscales  int
+		}{
+			Min_quality: getEnvInt("MAX_BYTES_MIN_QUALITY", 30),
+			Downscales:  getEnvInt("MAX_BYTES_DOWNSCALES", 4),
+		},
+		Palette: struct {
+			Colors int
+			Dither bool
+		}{
+			Colors: getEnvInt("PALETTE_COLORS", 256),
+			Dither: getEnvBool("PALETTE_DITHER", true),
+		},
+		Watermark: struct {
+			Dir            string
+			Check_interval int
+		}{
+			Dir:            getEnvString("WATERMARK_DIR", "", false),
+			Check_interval: getEnvInt("WATERMARK_CHECK_INTERVAL", 10),
+		},
 	}
 	checkConfig()
 }
 
+// Redacted returns a copy of the config with its secrets blanked out, for
+// logging.
+func Redacted() config {
+	c := *Cfg
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "[redacted]"
+		}
+	}
+	redact(&c.Companion.Secret_key)
+	redact(&c.Companion.Secondary_keys)
+	c.Companion.Keys = make([]Key, len(Cfg.Companion.Keys))
+	for i, key := range Cfg.Companion.Keys {
+		c.Companion.Keys[i] = key
+		redact(&c.Companion.Keys[i].Secret)
+	}
+	redact(&c.Admin.Token)
+	redact(&c.Cdn.Tag_key)
+	redact(&c.Peers.Token)
+	redact(&c.Signing.Key)
+	if u, err := url.Parse(c.Proxy); err == nil {
+		// Keep the proxy address but not its password
+		c.Proxy = u.Redacted()
+	}
+	return c
+}
+
+// parseKeys builds the keyring from the primary key and the comma
+// separated "id:key" pairs in SECONDARY_SECRET_KEYS.
+func parseKeys() []Key {
+	keys := []Key{{Id: Cfg.Companion.Secret_key_id, Secret: Cfg.Companion.Secret_key}}
+	for _, pair := range strings.Split(Cfg.Companion.Secondary_keys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok {
+			log.Fatalf("Invalid entry '%s' in 'SECONDARY_SECRET_KEYS', expected 'id:key'.\n", pair)
+		}
+		keys = append(keys, Key{Id: id, Secret: secret})
+	}
+	return keys
+}
+
+// parseIdRoutes parses the comma separated "prefix=policy" pairs in
+// ID_POLICY_ROUTES. Prefixes may not repeat or take over a built-in
+// route.
+func parseIdRoutes() []IdRoute {
+	reserved := map[string]string{
+		"/vi/":           "the image proxy",
+		"/_peer/vi/":     "the peer API",
+		Cfg.Admin.Prefix: "the admin API",
+	}
+	seen := map[string]bool{}
+	var routes []IdRoute
+	for _, pair := range strings.Split(Cfg.Id_policy.Routes, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, policy, ok := strings.Cut(pair, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			log.Fatalf("Invalid entry '%s' in 'ID_POLICY_ROUTES', expected '/prefix/=policy'.\n", pair)
+		}
+		if name, ok := reserved[prefix]; ok {
+			log.Fatalf("Prefix '%s' in 'ID_POLICY_ROUTES' is already used by %s.\n", prefix, name)
+		}
+		if seen[prefix] {
+			log.Fatalf("Prefix '%s' is used more than once in 'ID_POLICY_ROUTES'.\n", prefix)
+		}
+		seen[prefix] = true
+		routes = append(routes, IdRoute{Prefix: prefix, Policy: strings.ToLower(policy)})
+	}
+	return routes
+}
+
+// parseBreakpoints reads CLIENT_HINTS_BREAKPOINTS, a comma separated list
+// of widths, and returns it sorted.
+func parseBreakpoints() []int {
+	var breakpoints []int
+	for _, v := range strings.Split(Cfg.Client_hints.Breakpoints, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		width, err := strconv.Atoi(v)
+		if err != nil || width <= 0 {
+			log.Fatalf("Invalid width '%s' in 'CLIENT_HINTS_BREAKPOINTS'.\n", v)
+		}
+		breakpoints = append(breakpoints, width)
+	}
+	sort.Ints(breakpoints)
+	return breakpoints
+}
+
+func validIdPolicy(policy string) bool {
+	return policy == "encoded" || policy == "raw" || policy == "both"
+}
+
 func checkConfig() {
 	if len(Cfg.Companion.Secret_key) != 16 {
 		log.Fatalln("The value of environment variable 'SECRET_KEY' needs to be exactly 16 characters.")
 	}
+	Cfg.Companion.Keys = parseKeys()
+	seen := map[string]bool{}
+	for _, key := range Cfg.Companion.Keys {
+		if key.Id == "" || seen[key.Id] {
+			log.Fatalf("The secret key ID '%s' is empty or used more than once.\n", key.Id)
+		}
+		if len(key.Secret) != 16 {
+			log.Fatalf("The secret key '%s' needs to be exactly 16 characters.\n", key.Id)
+		}
+		seen[key.Id] = true
+	}
+	if Cfg.Companion.V1_key_id == "" {
+		Cfg.Companion.V1_key_id = Cfg.Companion.Secret_key_id
+	} else if !seen[Cfg.Companion.V1_key_id] {
+		log.Fatalf("'V1_SECRET_KEY_ID' refers to unknown key '%s'.\n", Cfg.Companion.V1_key_id)
+	}
+	if Cfg.Upgrade.Enabled && Cfg.Upgrade.Interval < 1 {
+		log.Fatalln("'UPGRADE_INTERVAL' needs to be at least 1.")
+	}
+	if Cfg.Availability.Enabled && Cfg.Availability.Path != "" && Cfg.Availability.Save_interval < 1 {
+		log.Fatalln("'AVAILABILITY_SAVE_INTERVAL' needs to be at least 1.")
+	}
+	if (Cfg.Peers.List != "" || Cfg.Peers.Srv != "") && (Cfg.Peers.Self == "" || Cfg.Peers.Token == "") {
+		log.Fatalln("Peer mode needs both 'PEER_SELF' and 'PEER_TOKEN' to be set.")
+	}
+	if Cfg.Peers.Srv != "" && Cfg.Peers.Refresh < 1 {
+		log.Fatalln("'PEER_REFRESH' needs to be at least 1.")
+	}
+	if (Cfg.Cdn.Enable_tags || Cfg.Cdn.Purge_endpoints != "") && Cfg.Cdn.Tag_key == "" {
+		log.Fatalln("'ENABLE_CACHE_TAGS' and 'CDN_PURGE_ENDPOINTS' need 'CDN_TAG_KEY' to be set.")
+	}
+	if Cfg.Signing.Enforce && Cfg.Signing.Key == "" {
+		log.Fatalln("'ENFORCE_URL_SIGNING' needs 'URL_SIGNING_KEY' to be set.")
+	}
+	Cfg.Id_policy.Default = strings.ToLower(Cfg.Id_policy.Default)
+	Cfg.Id_policy.Uds = strings.ToLower(Cfg.Id_policy.Uds)
+	Cfg.Id_policy.Route_list = parseIdRoutes()
+	if !validIdPolicy(Cfg.Id_policy.Default) {
+		log.Fatalf("Invalid 'ID_POLICY' '%s', expected 'encoded', 'raw' or 'both'.\n", Cfg.Id_policy.Default)
+	}
+	if Cfg.Id_policy.Uds != "" && !validIdPolicy(Cfg.Id_policy.Uds) {
+		log.Fatalf("Invalid 'UDS_ID_POLICY' '%s', expected 'encoded', 'raw' or 'both'.\n", Cfg.Id_policy.Uds)
+	}
+	for _, route := range Cfg.Id_policy.Route_list {
+		if !validIdPolicy(route.Policy) {
+			log.Fatalf("Invalid policy '%s' for '%s' in 'ID_POLICY_ROUTES', expected 'encoded', 'raw' or 'both'.\n", route.Policy, route.Prefix)
+		}
+	}
+	if Cfg.Blocklist.Mode != "block" && Cfg.Blocklist.Mode != "allow" {
+		log.Fatalf("Invalid 'BLOCKLIST_MODE' '%s', expected 'block' or 'allow'.\n", Cfg.Blocklist.Mode)
+	}
+	if Cfg.Blocklist.Path != "" && Cfg.Blocklist.Reload_interval < 1 {
+		log.Fatalln("'BLOCKLIST_RELOAD_INTERVAL' needs to be at least 1.")
+	}
+	if c := Cfg.Rate_limit; c.Enabled {
+		if c.Hit_rate <= 0 || c.Miss_rate <= 0 {
+			log.Fatalln("'RATE_LIMIT_HIT_RATE' and 'RATE_LIMIT_MISS_RATE' need to be greater than 0.")
+		}
+		if c.Hit_burst < 1 || c.Miss_burst < 1 {
+			log.Fatalln("'RATE_LIMIT_HIT_BURST' and 'RATE_LIMIT_MISS_BURST' need to be at least 1.")
+		}
+		if c.Process_weight < 1 || c.Process_weight > float64(c.Miss_burst) {
+			log.Fatalf("'RATE_LIMIT_PROCESS_WEIGHT' needs to be between 1 and 'RATE_LIMIT_MISS_BURST' (%d).\n", c.Miss_burst)
+		}
+	}
+	if Cfg.Cors.Credentials {
+		for _, origin := range strings.Split(Cfg.Cors.Origins, ",") {
+			if strings.TrimSpace(origin) == "*" {
+				log.Fatalln("'CORS_ALLOW_CREDENTIALS' needs an explicit list of origins in 'CORS_ALLOW_ORIGINS' instead of '*'.")
+			}
+		}
+	}
+	if Cfg.Limits.Max_dpr < 1 {
+		log.Fatalln("'MAX_DPR' needs to be at least 1.")
+	}
+	Cfg.Client_hints.Breakpoint_list = parseBreakpoints()
+	if q := Cfg.Client_hints.Save_data_quality; q < 1 || q > 100 {
+		log.Fatalln("'SAVE_DATA_QUALITY' needs to be between 1 and 100.")
+	}
+	if q := Cfg.Max_bytes.Min_quality; q < 1 || q > 100 {
+		log.Fatalln("'MAX_BYTES_MIN_QUALITY' needs to be between 1 and 100.")
+	}
+	if c := Cfg.Palette.Colors; c < 2 || c > 256 {
+		log.Fatalln("'PALETTE_COLORS' needs to be between 2 and 256.")
+	}
+	if dir := Cfg.Watermark.Dir; dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalf("'WATERMARK_DIR' '%s' is not a directory.\n", dir)
+		}
+		if Cfg.Watermark.Check_interval < 1 {
+			log.Fatalln("'WATERMARK_CHECK_INTERVAL' needs to be at least 1.")
+		}
+	}
 }
@@ -0,0 +1,141 @@
+// Package cors sets the CORS headers of every public response from one
+// configured policy.
+package cors
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+)
+
+// Policy is a CORS configuration. Origins are exact ("https://a.com") or
+// wildcard ("https://*.a.com") patterns, "*" allows every origin.
+type Policy struct {
+	origins     []string
+	anyOrigin   bool
+	methods     []string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      int
+}
+
+var policy *Policy
+
+func split(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func New(origins, methods, headers, expose string, credentials bool, maxAge int) *Policy {
+	p := &Policy{
+		headers:     strings.Join(split(headers), ", "),
+		expose:      strings.Join(split(expose), ", "),
+		credentials: credentials,
+		maxAge:      maxAge,
+	}
+	for _, origin := range split(origins) {
+		if origin == "*" {
+			p.anyOrigin = true
+		}
+		p.origins = append(p.origins, strings.ToLower(origin))
+	}
+	for _, method := range split(methods) {
+		p.methods = append(p.methods, strings.ToUpper(method))
+	}
+	return p
+}
+
+// Start builds the process wide policy from the config.
+func Start() {
+	c := config.Cfg.Cors
+	policy = New(c.Origins, c.Methods, c.Headers, c.Expose, c.Credentials, c.Max_age)
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin for a
+// request origin, or the empty string if it is not allowed. A wildcard
+// policy answers "*", config validation keeps it from allowing
+// credentials.
+func (p *Policy) allowOrigin(origin string) string {
+	if p.anyOrigin {
+		return "*"
+	}
+	if origin == "" {
+		return ""
+	}
+	lower := strings.ToLower(origin)
+	for _, pattern := range p.origins {
+		if ok, _ := path.Match(pattern, lower); ok {
+			return origin
+		}
+	}
+	return ""
+}
+
+func (p *Policy) allowsMethod(method string) bool {
+	for _, m := range p.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the CORS headers of a response. It answers OPTIONS requests
+// itself, as preflight requests, and then returns true.
+func (p *Policy) Apply(w http.ResponseWriter, req *http.Request) bool {
+	h := w.Header()
+	allowed := p.allowOrigin(req.Header.Get("Origin"))
+	if allowed != "*" {
+		// The response depends on the origin, caches must keep them apart
+		h.Add("Vary", "Origin")
+	}
+
+	if req.Method == "OPTIONS" {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		method := req.Header.Get("Access-Control-Request-Method")
+		if allowed != "" && (method == "" || p.allowsMethod(method)) {
+			h.Set("Access-Control-Allow-Origin", allowed)
+			h.Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+			headers := p.headers
+			if headers == "*" && p.credentials {
+				// "*" is taken literally on credentialed requests
+				headers = req.Header.Get("Access-Control-Request-Headers")
+			}
+			if headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			if p.credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			h.Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	if allowed != "" {
+		h.Set("Access-Control-Allow-Origin", allowed)
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if p.expose != "" {
+			h.Set("Access-Control-Expose-Headers", p.expose)
+		}
+	}
+	return false
+}
+
+// Apply applies the process wide policy, see Policy.Apply.
+func Apply(w http.ResponseWriter, req *http.Request) bool {
+	return policy.Apply(w, req)
+}
@@ -0,0 +1,144 @@
+// Package hotlink implements Referer based hotlink protection like the
+// Referer whitelist of Alibaba OSS buckets. Requests are checked against
+// allow and deny lists of host patterns, and violations are answered with
+// 403 or a placeholder image.
+package hotlink
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+var enabled bool
+var allow []string
+var deny []string
+var placeholder []byte
+var placeholderType string
+
+// Start parses the lists and loads the placeholder image. Hotlink
+// protection stays disabled when both lists are empty.
+func Start() {
+	c := config.Cfg.Hotlink
+	allow = ParsePatterns(c.Allow)
+	deny = ParsePatterns(c.Deny)
+	enabled = len(allow) > 0 || len(deny) > 0
+	if !enabled {
+		return
+	}
+
+	if c.Placeholder != "" {
+		data, err := os.ReadFile(c.Placeholder)
+		if err != nil {
+			log.Printf("[ERROR] [hotlink] Failed to read placeholder '%s', answering with 403 instead: %s\n", c.Placeholder, err)
+		} else {
+			placeholder = data
+			placeholderType = http.DetectContentType(data)
+		}
+	}
+	log.Printf("[INFO] Hotlink protection enabled with %d allowed and %d denied patterns\n", len(allow), len(deny))
+}
+
+// ParsePatterns parses a comma separated list of host patterns such as
+// "example.com" or "*.example.com". Patterns use path.Match syntax and
+// are matched case-insensitively.
+func ParsePatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			log.Printf("[ERROR] [hotlink] Ignoring invalid pattern '%s': %s\n", p, err)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+func matchAny(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOf returns the lower case host of a Referer or Origin header, or
+// the empty string if it has none (e.g. "null"), which is treated like an
+// absent header.
+func hostOf(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Allowed reports whether a request passes the Referer and Origin checks.
+// Every header that is present must match the allow list (if any) and
+// must not match the deny list, which takes precedence. Requests carrying
+// neither header pass only if empty referers are allowed.
+func Allowed(req *http.Request) bool {
+	if !enabled {
+		return true
+	}
+
+	var hosts []string
+	for _, key := range []string{"Referer", "Origin"} {
+		if host := hostOf(req.Header.Get(key)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return config.Cfg.Hotlink.Allow_empty
+	}
+
+	for _, host := range hosts {
+		if matchAny(deny, host) {
+			return false
+		}
+		if len(allow) > 0 && !matchAny(allow, host) {
+			return false
+		}
+	}
+	return true
+}
+
+// Vary marks a response as depending on the Referer and Origin headers
+// while protection is enabled, so shared caches never hand a response
+// made for an allowed site to a hotlinker.
+func Vary(h http.Header) {
+	if enabled {
+		h.Add("Vary", "Referer, Origin")
+	}
+}
+
+// Reject answers a request that failed the check, with the placeholder
+// image if one is configured and 403 otherwise. Neither may be cached,
+// since the same URL is served normally to allowed referers.
+func Reject(w http.ResponseWriter) {
+	metrics.Inc("hotlink_rejected")
+	w.Header().Set("Cache-Control", "no-store")
+	Vary(w.Header())
+	if placeholder != nil {
+		w.Header().Set("Content-Type", placeholderType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(placeholder)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(placeholder)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+	io.WriteString(w, "You are denied by bucket referer policy.")
+}
@@ -0,0 +1,384 @@
+package jpegenc
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Subsampling is the chroma subsampling of a color image.
+type Subsampling int
+
+const (
+	// Subsample420 halves the chroma resolution in both directions, the
+	// image/jpeg default.
+	Subsample420 Subsampling = iota
+	// Subsample422 halves the chroma resolution horizontally.
+	Subsample422
+	// Subsample444 keeps full chroma resolution, for text and sharp edges.
+	Subsample444
+)
+
+// factors returns the luma sampling factors of a subsampling. Chroma is
+// always sampled 1x1.
+func (s Subsampling) factors() (h, v int) {
+	switch s {
+	case Subsample422:
+		return 2, 1
+	case Subsample444:
+		return 1, 1
+	}
+	return 2, 2
+}
+
+// DefaultQuality is the default quality encoding parameter.
+const DefaultQuality = 75
+
+// Options are the encoding parameters.
+type Options struct {
+	// Quality ranges from 1 to 100 inclusive, higher is better.
+	Quality int
+	// Progressive writes a progressive instead of a baseline JPEG.
+	Progressive bool
+	// Subsampling is ignored for grayscale images.
+	Subsampling Subsampling
+	// Segments are complete marker segments, starting with 0xff and the
+	// marker, written right after the Start Of Image marker.
+	Segments [][]byte
+}
+
+// scan is one scan of a progressive script: the components it covers and
+// its spectral selection.
+type scan struct {
+	comps  []int
+	ss, se int
+}
+
+var (
+	baselineScriptY     = []scan{{[]int{0}, 0, 63}}
+	baselineScriptYCbCr = []scan{{[]int{0, 1, 2}, 0, 63}}
+	// The progressive scripts send all DC coefficients first, then the low
+	// luma frequencies, the chroma and the remaining luma frequencies, the
+	// order libjpeg's jpeg_simple_progression uses minus successive
+	// approximation.
+	progressiveScriptY = []scan{
+		{[]int{0}, 0, 0},
+		{[]int{0}, 1, 5},
+		{[]int{0}, 6, 63},
+	}
+	progressiveScriptYCbCr = []scan{
+		{[]int{0, 1, 2}, 0, 0},
+		{[]int{0}, 1, 5},
+		{[]int{2}, 1, 63},
+		{[]int{1}, 1, 63},
+		{[]int{0}, 6, 63},
+	}
+)
+
+// plane holds the quantized coefficients of one component, in zig-zag
+// order, for every block of the MCU-padded image.
+type plane struct {
+	h, v int // Sampling factors.
+	// bw and bh are the padded dimensions in blocks, cw and ch the
+	// dimensions a non-interleaved scan covers.
+	bw, bh, cw, ch int
+	q              quantIndex
+	blocks         []block
+}
+
+// Encode writes the Image m to w in JPEG format with the given options.
+// Default parameters are used if a nil *[Options] is passed.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("jpeg: image is too large to encode")
+	}
+	if o == nil {
+		o = &Options{Quality: DefaultQuality}
+	}
+	var e encoder
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	e.initQuant(o.Quality)
+
+	_, gray := m.(*image.Gray)
+	planes := e.transform(m, gray, o.Subsampling)
+
+	script := baselineScriptYCbCr
+	switch {
+	case gray && o.Progressive:
+		script = progressiveScriptY
+	case gray:
+		script = baselineScriptY
+	case o.Progressive:
+		script = progressiveScriptYCbCr
+	}
+
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = soiMarker
+	e.write(e.buf[:2])
+	for _, segment := range o.Segments {
+		e.write(segment)
+	}
+	// Write the quantization tables.
+	e.writeDQT()
+	// Write the image dimensions.
+	e.writeSOF(b.Size(), planes, o.Progressive)
+	// Write the Huffman tables.
+	e.writeDHT(len(planes))
+	// Write the image data.
+	for _, s := range script {
+		e.writeScan(planes, s)
+	}
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = eoiMarker
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
+
+// initQuant scales the quantization tables for a quality.
+func (e *encoder) initQuant(quality int) {
+	// Clip quality to [1, 100].
+	quality = max(1, min(100, quality))
+	// Convert from a quality rating to a scaling factor.
+	var scale int
+	if quality < 50 {
+		scale = 5000 / quality
+	} else {
+		scale = 200 - quality*2
+	}
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			x := int(unscaledQuant[i][j])
+			x = (x*scale + 50) / 100
+			e.quant[i][j] = uint8(max(1, min(255, x)))
+		}
+	}
+}
+
+// transform converts m to YCbCr, subsamples the chroma, and returns the
+// quantized DCT coefficients of every component.
+func (e *encoder) transform(m image.Image, gray bool, subsampling Subsampling) []*plane {
+	bounds := m.Bounds()
+	hMax, vMax := 1, 1
+	if !gray {
+		hMax, vMax = subsampling.factors()
+	}
+	mxx := (bounds.Dx() + 8*hMax - 1) / (8 * hMax)
+	myy := (bounds.Dy() + 8*vMax - 1) / (8 * vMax)
+
+	newPlane := func(h, v int, q quantIndex) *plane {
+		// Section A.1.1: a component is ceil(size * h / hMax) pixels wide.
+		cw := (bounds.Dx()*h + hMax - 1) / hMax
+		ch := (bounds.Dy()*v + vMax - 1) / vMax
+		p := &plane{h: h, v: v, bw: mxx * h, bh: myy * v, cw: (cw + 7) / 8, ch: (ch + 7) / 8, q: q}
+		p.blocks = make([]block, p.bw*p.bh)
+		return p
+	}
+	planes := []*plane{newPlane(hMax, vMax, quantIndexLuminance)}
+	if !gray {
+		planes = append(planes, newPlane(1, 1, quantIndexChrominance), newPlane(1, 1, quantIndexChrominance))
+	}
+
+	var (
+		// Scratch buffers to hold the YCbCr values.
+		// The blocks are in natural (not zig-zag) order.
+		cb, cr [4]block
+	)
+	rgba, _ := m.(*image.RGBA)
+	nrgba, _ := m.(*image.NRGBA)
+	ycbcr, _ := m.(*image.YCbCr)
+	for my := 0; my < myy; my++ {
+		for mx := 0; mx < mxx; mx++ {
+			for i := 0; i < hMax*vMax; i++ {
+				bx, by := mx*hMax+i%hMax, my*vMax+i/hMax
+				y := &planes[0].blocks[by*planes[0].bw+bx]
+				p := image.Pt(bounds.Min.X+8*bx, bounds.Min.Y+8*by)
+				switch {
+				case gray:
+					grayToY(m.(*image.Gray), p, y)
+				case rgba != nil:
+					rgbaToYCbCr(rgba, p, y, &cb[i], &cr[i])
+				case nrgba != nil:
+					nrgbaToYCbCr(nrgba, p, y, &cb[i], &cr[i])
+				case ycbcr != nil:
+					yCbCrToYCbCr(ycbcr, p, y, &cb[i], &cr[i])
+				default:
+					toYCbCr(m, p, y, &cb[i], &cr[i])
+				}
+				e.quantize(y, quantIndexLuminance)
+			}
+			if !gray {
+				c := &planes[1].blocks[my*mxx+mx]
+				downsample(c, &cb, hMax, vMax)
+				e.quantize(c, quantIndexChrominance)
+				c = &planes[2].blocks[my*mxx+mx]
+				downsample(c, &cr, hMax, vMax)
+				e.quantize(c, quantIndexChrominance)
+			}
+		}
+	}
+	return planes
+}
+
+// quantize replaces the pixels of b, in natural order, with its quantized
+// DCT coefficients in zig-zag order.
+func (e *encoder) quantize(b *block, q quantIndex) {
+	fdct(b)
+	var z block
+	for zig := 0; zig < blockSize; zig++ {
+		z[zig] = div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+	}
+	*b = z
+}
+
+// nrgbaToYCbCr is a specialized version of toYCbCr for image.NRGBA images,
+// which is what github.com/disintegration/imaging produces.
+func nrgbaToYCbCr(m *image.NRGBA, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		sy := min(p.Y+j, ymax)
+		offset := (sy-b.Min.Y)*m.Stride - b.Min.X*4
+		for i := 0; i < 8; i++ {
+			sx := min(p.X+i, xmax)
+			pix := m.Pix[offset+sx*4:]
+			r, g, bb := pix[0], pix[1], pix[2]
+			if pix[3] != 0xff {
+				// Premultiply like color.NRGBA.RGBA does.
+				r16, g16, b16, _ := color.NRGBA{r, g, bb, pix[3]}.RGBA()
+				r, g, bb = uint8(r16>>8), uint8(g16>>8), uint8(b16>>8)
+			}
+			yy, cb, cr := color.RGBToYCbCr(r, g, bb)
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
+		}
+	}
+}
+
+// downsample scales the 8h x 8v region represented by the first h*v src
+// blocks, in row-major order, to the 8x8 dst block.
+func downsample(dst *block, src *[4]block, h, v int) {
+	if h == 1 && v == 1 {
+		*dst = src[0]
+		return
+	}
+	n := int32(h * v)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			var sum int32
+			for dy := 0; dy < v; dy++ {
+				for dx := 0; dx < h; dx++ {
+					sx, sy := x*h+dx, y*v+dy
+					sum += src[(sy/8)*h+sx/8][(sy%8)*8+sx%8]
+				}
+			}
+			dst[8*y+x] = (sum + n/2) / n
+		}
+	}
+}
+
+// writeSOF writes the Start Of Frame marker, baseline or progressive.
+func (e *encoder) writeSOF(size image.Point, planes []*plane, progressive bool) {
+	marker := uint8(sof0Marker)
+	if progressive {
+		marker = sof2Marker
+	}
+	e.writeMarkerHeader(marker, 8+3*len(planes))
+	e.buf[0] = 8 // 8-bit color.
+	e.buf[1] = uint8(size.Y >> 8)
+	e.buf[2] = uint8(size.Y & 0xff)
+	e.buf[3] = uint8(size.X >> 8)
+	e.buf[4] = uint8(size.X & 0xff)
+	e.buf[5] = uint8(len(planes))
+	for i, p := range planes {
+		e.buf[3*i+6] = uint8(i + 1)
+		e.buf[3*i+7] = uint8(p.h<<4 | p.v)
+		e.buf[3*i+8] = uint8(p.q)
+	}
+	e.write(e.buf[:3*len(planes)+6])
+}
+
+// writeScan writes one Start Of Scan marker and its entropy-coded data.
+// Scans of several components are interleaved by MCU, single component
+// scans visit the component's blocks in raster order (section A.2).
+func (e *encoder) writeScan(planes []*plane, s scan) {
+	e.writeMarkerHeader(sosMarker, 6+2*len(s.comps))
+	e.writeByte(uint8(len(s.comps)))
+	for _, c := range s.comps {
+		e.writeByte(uint8(c + 1))
+		// Luma uses tables 0, chroma tables 1, for both DC and AC.
+		e.writeByte(uint8(planes[c].q)<<4 | uint8(planes[c].q))
+	}
+	e.writeByte(uint8(s.ss))
+	e.writeByte(uint8(s.se))
+	e.writeByte(0x00)
+
+	// DC components are delta-encoded.
+	var prevDC [3]int32
+	if len(s.comps) == 1 {
+		c := s.comps[0]
+		p := planes[c]
+		for by := 0; by < p.ch; by++ {
+			for bx := 0; bx < p.cw; bx++ {
+				prevDC[c] = e.writeBlock(&p.blocks[by*p.bw+bx], p.q, prevDC[c], s.ss, s.se)
+			}
+		}
+	} else {
+		mxx, myy := planes[0].bw/planes[0].h, planes[0].bh/planes[0].v
+		for my := 0; my < myy; my++ {
+			for mx := 0; mx < mxx; mx++ {
+				for _, c := range s.comps {
+					p := planes[c]
+					for i := 0; i < p.h*p.v; i++ {
+						bx, by := mx*p.h+i%p.h, my*p.v+i/p.h
+						prevDC[c] = e.writeBlock(&p.blocks[by*p.bw+bx], p.q, prevDC[c], s.ss, s.se)
+					}
+				}
+			}
+		}
+	}
+	// Pad the last byte with 1's and start the next scan on a byte.
+	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+// writeBlock writes the coefficients ss through se of a quantized block, in
+// zig-zag order, returning its DC value. A progressive AC scan codes its
+// band exactly like a baseline block, where EOB is the EOB0 symbol.
+func (e *encoder) writeBlock(b *block, q quantIndex, prevDC int32, ss, se int) int32 {
+	if ss == 0 {
+		// Emit the DC delta.
+		e.emitHuffRLE(huffIndex(2*q+0), 0, b[0]-prevDC)
+		ss = 1
+	}
+	// Emit the AC components.
+	h, runLength := huffIndex(2*q+1), int32(0)
+	for zig := ss; zig <= se; zig++ {
+		ac := b[zig]
+		if ac == 0 {
+			runLength++
+		} else {
+			for runLength > 15 {
+				e.emitHuff(h, 0xf0)
+				runLength -= 16
+			}
+			e.emitHuffRLE(h, runLength, ac)
+			runLength = 0
+		}
+	}
+	if runLength > 0 {
+		e.emitHuff(h, 0x00)
+	}
+	return b[0]
+}
@@ -0,0 +1,89 @@
+package jpegenc
+
+import "bytes"
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// Metadata returns the APP1 EXIF and APP2 ICC profile segments of a JPEG
+// file, as selected, in file order and ready for Options.Segments. Anything
+// that is not a well-formed JPEG header yields no segments.
+func Metadata(data []byte, icc, exif bool) [][]byte {
+	if len(data) < 2 || data[0] != 0xff || data[1] != soiMarker {
+		return nil
+	}
+	var segments [][]byte
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return segments
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte.
+			i++
+			continue
+		case marker == sosMarker || marker == eoiMarker:
+			// The metadata comes before the image data.
+			return segments
+		case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+			// Markers without a length.
+			i += 2
+			continue
+		}
+		n := int(data[i+2])<<8 | int(data[i+3])
+		if n < 2 || i+2+n > len(data) {
+			return segments
+		}
+		segment, payload := data[i:i+2+n], data[i+4:i+2+n]
+		if (exif && marker == 0xe1 && bytes.HasPrefix(payload, exifHeader)) ||
+			(icc && marker == 0xe2 && bytes.HasPrefix(payload, iccHeader)) {
+			segments = append(segments, segment)
+		}
+		i += 2 + n
+	}
+	return segments
+}
+
+// StripMetadata returns a JPEG file without its APP1 (EXIF, XMP), APP13
+// (IPTC) and comment segments. Everything else, including the JFIF header,
+// the ICC profile and the image data, is copied byte for byte. Anything
+// that is not a well-formed JPEG header is returned unchanged.
+func StripMetadata(data []byte) []byte {
+	if len(data) < 2 || data[0] != 0xff || data[1] != soiMarker {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return data
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte.
+			i++
+			continue
+		case marker == sosMarker || marker == eoiMarker:
+			// The rest is image data.
+			return append(out, data[i:]...)
+		case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+			// Markers without a length.
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+		n := int(data[i+2])<<8 | int(data[i+3])
+		if n < 2 || i+2+n > len(data) {
+			return data
+		}
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			out = append(out, data[i:i+2+n]...)
+		}
+		i += 2 + n
+	}
+	return data
+}
@@ -0,0 +1,45 @@
+package jpegenc
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// TestStripMetadata checks that EXIF, XMP, IPTC and comment segments are
+// removed and everything else is kept byte for byte.
+func TestStripMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	src := buf.Bytes()
+
+	icc := "\xff\xe2\x00\x12ICC_PROFILE\x00\x01\x01xy"
+	header := "\xff\xd8" +
+		"\xff\xe1\x00\x0cExif\x00\x00ABCD" +
+		icc +
+		"\xff\xe1\x00\x06http" +
+		"\xff\xed\x00\x06IPTC" +
+		"\xff\xfe\x00\x05hi!"
+	data := append([]byte(header), src[2:]...)
+	want := append([]byte("\xff\xd8"+icc), src[2:]...)
+
+	got := StripMetadata(data)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+		t.Fatal(err)
+	}
+	if segments := Metadata(got, true, true); len(segments) != 1 {
+		t.Errorf("%d metadata segments left, want only the ICC profile", len(segments))
+	}
+
+	// A segment running past the end is not touched
+	broken := []byte("\xff\xd8\xff\xe1\x00\x40Exif")
+	if got := StripMetadata(broken); !bytes.Equal(got, broken) {
+		t.Errorf("malformed header was changed")
+	}
+}
@@ -0,0 +1,89 @@
+package jpegscale
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG encodes m with image/jpeg.
+func testJPEG(t testing.TB, m image.Image, quality int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gradient(width, height int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x * y) % 251), 0xff})
+		}
+	}
+	return m
+}
+
+func gray(width, height int) *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.SetGray(x, y, color.Gray{uint8((x*7 + y*13) % 256)})
+		}
+	}
+	return m
+}
+
+// TestScaleOneMatchesStdlib checks that a decode at scale 1 is identical
+// to image/jpeg, which the fork is derived from.
+func TestScaleOneMatchesStdlib(t *testing.T) {
+	tests := []struct {
+		name string
+		m    image.Image
+	}{
+		{"ycbcr", gradient(333, 187)},
+		{"gray", gray(120, 77)},
+	}
+	for _, test := range tests {
+		for _, quality := range []int{50, 85, 100} {
+			data := testJPEG(t, test.m, quality)
+			want, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecodeScaled(bytes.NewReader(data), 1)
+			if err != nil {
+				t.Fatalf("%s q%d: %v", test.name, quality, err)
+			}
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("%s q%d: bounds %v, want %v", test.name, quality, got.Bounds(), want.Bounds())
+			}
+			b := want.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got.At(x, y) != want.At(x, y) {
+						t.Fatalf("%s q%d: pixel (%d, %d) is %v, want %v", test.name, quality, x, y, got.At(x, y), want.At(x, y))
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestScaledBounds checks that scaled decodes round the size up.
+func TestScaledBounds(t *testing.T) {
+	data := testJPEG(t, gradient(333, 187), 85)
+	for _, scale := range []int{2, 4, 8} {
+		m, err := DecodeScaled(bytes.NewReader(data), scale)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := image.Rect(0, 0, (333+scale-1)/scale, (187+scale-1)/scale)
+		if m.Bounds() != want {
+			t.Errorf("scale %d: bounds %v, want %v", scale, m.Bounds(), want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package jpegscale
+
+import "math"
+
+// idctTables holds, for each reduced block size n of 1, 2 and 4, the n-point
+// inverse DCT basis: idctTables[n][x*8+u] = C(u)/2 * cos((2x+1)*u*π/2n).
+// Evaluating the low n frequencies of an 8-point block at n points samples
+// the 8-point reconstruction at the centre of each group of 8/n pixels,
+// which is how libjpeg's reduced-size IDCTs work.
+var idctTables [5][blockSize]float32
+
+func init() {
+	for _, n := range []int{1, 2, 4} {
+		for x := 0; x < n; x++ {
+			for u := 0; u < n; u++ {
+				c := 0.5
+				if u == 0 {
+					c = 0.5 / math.Sqrt2
+				}
+				idctTables[n][x*8+u] = float32(c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n)))
+			}
+		}
+	}
+}
+
+// idctScaled is the reduced-size counterpart of idct. It transforms the
+// top-left n×n dequantized coefficients of b and leaves the n×n result, not
+// yet level shifted, in the top-left corner of b.
+func idctScaled(b *block, n int) {
+	if n == 1 {
+		// DC only: the average of the block is DC/8.
+		b[0] = (b[0] + 4*sign(b[0])) / 8
+		return
+	}
+
+	t := &idctTables[n]
+	var tmp [blockSize]float32
+	// Rows: tmp[v*8+x] = Σu t[x][u] * b[v][u].
+	for v := 0; v < n; v++ {
+		for x := 0; x < n; x++ {
+			var sum float32
+			for u := 0; u < n; u++ {
+				sum += t[x*8+u] * float32(b[v*8+u])
+			}
+			tmp[v*8+x] = sum
+		}
+	}
+	// Columns: b[y*8+x] = Σv t[y][v] * tmp[v][x].
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			var sum float32
+			for v := 0; v < n; v++ {
+				sum += t[y*8+v] * tmp[v*8+x]
+			}
+			b[y*8+x] = int32(math.Round(float64(sum)))
+		}
+	}
+}
+
+func sign(x int32) int32 {
+	if x < 0 {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,92 @@
+// Package metrics keeps process wide counters and gauges that are served
+// as JSON on the admin API.
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var mu sync.RWMutex
+var counters = map[string]*atomic.Int64{}
+var gauges = map[string]func() any{}
+
+func counter(name string) *atomic.Int64 {
+	mu.RLock()
+	c, ok := counters[name]
+	mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if c, ok = counters[name]; !ok {
+		c = new(atomic.Int64)
+		counters[name] = c
+	}
+	return c
+}
+
+// Add adds delta to the named counter, creating it if needed.
+func Add(name string, delta int64) {
+	counter(name).Add(delta)
+}
+
+// Inc increments the named counter by one.
+func Inc(name string) {
+	counter(name).Add(1)
+}
+
+// Get returns the current value of the named counter.
+func Get(name string) int64 {
+	return counter(name).Load()
+}
+
+// Gauge registers a function whose result is reported under name every
+// time the stats are read.
+func Gauge(name string, fn func() any) {
+	mu.Lock()
+	defer mu.Unlock()
+	gauges[name] = fn
+}
+
+// Ratio returns hits / (hits + misses) for two counters, or 0 if neither
+// has been incremented yet.
+func Ratio(hits, misses string) float64 {
+	h := Get(hits)
+	total := h + Get(misses)
+	if total == 0 {
+		return 0
+	}
+	return float64(h) / float64(total)
+}
+
+// Snapshot returns the current value of every counter and gauge.
+func Snapshot() map[string]any {
+	mu.RLock()
+	out := make(map[string]any, len(counters)+len(gauges))
+	for name, c := range counters {
+		out[name] = c.Load()
+	}
+	fns := make(map[string]func() any, len(gauges))
+	for name, fn := range gauges {
+		fns[name] = fn
+	}
+	mu.RUnlock()
+
+	// Gauges may read counters themselves, so call them without the lock.
+	for name, fn := range fns {
+		out[name] = fn()
+	}
+	return out
+}
+
+// Handler serves the snapshot as JSON.
+func Handler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(Snapshot())
+}
@@ -0,0 +1,271 @@
+package paths
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/javadalmasi/Thumbs/internal/availability"
+	"github.com/javadalmasi/Thumbs/internal/cache"
+	"github.com/javadalmasi/Thumbs/internal/cdn"
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+	"github.com/javadalmasi/Thumbs/internal/peers"
+)
+
+// purgeLocal drops every cached variant of a video on this instance and
+// cascades to the availability index.
+func purgeLocal(videoId string) int {
+	n := cache.PurgeVideo(videoId)
+	availability.Forget(videoId)
+	return n
+}
+
+// Purge drops a video on this instance and every peer, and asks the
+// configured CDNs to purge the video's tag. It returns the number of
+// cache entries purged locally.
+func Purge(videoId string) int {
+	n := purgeLocal(videoId)
+	peers.BroadcastPurge(videoId)
+	cdn.Notify(videoId)
+	return n
+}
+
+// PurgeVariant drops one variant of a video on this instance and every
+// peer, and asks the configured CDNs to purge the variant's tag. It
+// returns the number of cache entries purged locally.
+func PurgeVariant(videoId, transform string) int {
+	n := cache.PurgeVariant(videoId, transform)
+	peers.BroadcastPurgeVariant(videoId, transform)
+	cdn.NotifyVariant(videoId, transform)
+	return n
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// adminVideoId reads the video from either the `id` (encoded) or the
+// `video_id` (decoded) query parameter.
+func adminVideoId(query url.Values) (string, error) {
+	if id := query.Get("id"); id != "" {
+		d, err := decodeID(id)
+		if errors.Is(err, errExpired) {
+			// Expired IDs can still be purged
+			err = nil
+		}
+		return d.VideoId, err
+	}
+	if videoId := query.Get("video_id"); videoId != "" {
+		if err := validateID(videoId, expectedInputLen); err != nil {
+			return "", fmt.Errorf("invalid video ID: %w", err)
+		}
+		return videoId, nil
+	}
+	return "", fmt.Errorf("missing 'id' or 'video_id' parameter")
+}
+
+// Admin serves the cache administration API below prefix:
+//
+//	POST {prefix}purge?id=...[&transform=...]
+//	GET  {prefix}variants?id=...
+//	GET  {prefix}stats
+//	GET  {prefix}metrics
+//	GET  {prefix}encode?video_id=...[&expires=...|&expires_in=...]
+//	GET  {prefix}sign?url=...[&expires=...|&expires_in=...]
+//	GET  {prefix}encrypt?query=...&id=...[&expires=...|&expires_in=...]
+//
+// Videos can be given with `id` (encoded) or `video_id` (decoded). The
+// optional `transform` is a URL encoded query string using the same
+// processing parameters as /vi/, for example `transform=width%3D320`,
+// and restricts the purge to that single variant.
+func Admin(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch strings.TrimPrefix(req.URL.Path, prefix) {
+		case "purge":
+			adminPurge(w, req)
+		case "variants":
+			adminVariants(w, req)
+		case "stats":
+			adminStats(w, req)
+		case "metrics":
+			metrics.Handler(w, req)
+		case "encode":
+			adminEncode(w, req)
+		case "sign":
+			adminSign(w, req)
+		case "encrypt":
+			adminEncrypt(w, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "Unknown admin endpoint")
+		}
+	}
+}
+
+func adminPurge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "DELETE" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST and DELETE requests are allowed.")
+		return
+	}
+
+	query := req.URL.Query()
+	videoId, err := adminVideoId(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !query.Has("transform") {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"video_id": videoId,
+			"purged":   Purge(videoId),
+		})
+		return
+	}
+
+	transformQuery, err := url.ParseQuery(query.Get("transform"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid transform: %v", err))
+		return
+	}
+	transform := parseOptions(transformQuery).canonical()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"video_id":  videoId,
+		"transform": transform,
+		"purged":    PurgeVariant(videoId, transform),
+	})
+}
+
+func adminVariants(w http.ResponseWriter, req *http.Request) {
+	videoId, err := adminVideoId(req.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"video_id": videoId,
+		"variants": cache.Variants(videoId),
+	})
+}
+
+func adminStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"cache":              cache.GetStats(),
+		"availability_index": availability.Len(),
+	})
+}
+
+func adminEncode(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	videoId := query.Get("video_id")
+	if err := validateID(videoId, expectedInputLen); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid video ID: %v", err))
+		return
+	}
+	expires, err := ParseExpiry(query.Get("expires"), query.Get("expires_in"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var id string
+	if expires.IsZero() {
+		id, err = EncodeID(videoId)
+	} else {
+		id, err = EncodeExpiringID(videoId, expires)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := map[string]any{
+		"video_id": videoId,
+		"id":       id,
+	}
+	if !expires.IsZero() {
+		result["expires"] = expires.Unix()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func adminSign(w http.ResponseWriter, req *http.Request) {
+	if config.Cfg.Signing.Key == "" {
+		writeJSONError(w, http.StatusNotImplemented, "URL signing is not configured.")
+		return
+	}
+	query := req.URL.Query()
+	rawURL := query.Get("url")
+	if rawURL == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'url' parameter.")
+		return
+	}
+	expires, err := ParseExpiry(query.Get("expires"), query.Get("expires_in"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	signed, err := SignURL(rawURL, expires)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid URL: %v", err))
+		return
+	}
+
+	result := map[string]any{
+		"url": signed,
+	}
+	if !expires.IsZero() {
+		result["expires"] = expires.Unix()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func adminEncrypt(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if !query.Has("query") {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'query' parameter.")
+		return
+	}
+	videoId, err := adminVideoId(query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expires, err := ParseExpiry(query.Get("expires"), query.Get("expires_in"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	blob, err := EncryptInstructions(videoId, query.Get("query"), expires)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err))
+		return
+	}
+
+	result := map[string]any{
+		"blob": blob,
+	}
+	if id := query.Get("id"); id != "" {
+		result["path"] = "/vi/" + id + "/e/" + blob
+	}
+	if !expires.IsZero() {
+		result["expires"] = expires.Unix()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
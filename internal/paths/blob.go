@@ -0,0 +1,80 @@
+package paths
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/utils"
+)
+
+// An instruction blob is a processing query, like "width=320&format=jpg",
+// encrypted with AES-256-GCM under a key derived from the keyring. It is
+// used as /vi/{id}/e/{blob} so clients can neither read nor change the
+// parameters. The decoded video ID is the additional data of the
+// encryption, so a blob only works for the video it was made for. The
+// optional expiry is stored in the blob as x-thumbs-expires.
+
+var errInvalidBlob = errors.New("invalid instruction blob")
+
+func blobKey(secret string) []byte {
+	return deriveSubkey(secret, "thumbs-blob")
+}
+
+// EncryptInstructions encrypts a processing query for a decoded video ID
+// with the primary key. If expires is not zero, the blob stops working
+// after it.
+func EncryptInstructions(videoId, rawQuery string, expires time.Time) (string, error) {
+	query, err := url.ParseQuery(strings.TrimPrefix(rawQuery, "?"))
+	if err != nil {
+		return "", err
+	}
+	query.Del(signatureParam)
+	query.Del(expiresParam)
+	if !expires.IsZero() {
+		query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	}
+	return utils.EncryptQueryParams(query.Encode(), blobKey(config.Cfg.Companion.Keys[0].Secret), videoId)
+}
+
+// decryptInstructions decrypts a blob of a decoded video ID with
+// whichever key of the keyring it was encrypted with, and returns its
+// query and expiry. An expired blob returns errExpired.
+func decryptInstructions(videoId, blob string) (url.Values, time.Time, error) {
+	for _, key := range config.Cfg.Companion.Keys {
+		rawQuery, err := utils.DecryptQueryParams(blob, blobKey(key.Secret), videoId)
+		if err != nil {
+			continue
+		}
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, time.Time{}, errInvalidBlob
+		}
+		var expires time.Time
+		if s := query.Get(expiresParam); s != "" {
+			unix, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, time.Time{}, errInvalidBlob
+			}
+			expires = time.Unix(unix, 0)
+			if time.Now().After(expires) {
+				return nil, time.Time{}, errExpired
+			}
+		}
+		return query, expires, nil
+	}
+	return nil, time.Time{}, errInvalidBlob
+}
+
+// instructionBlob returns the blob of a /vi/{id}/e/{blob} request.
+func instructionBlob(req *http.Request) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), routeOf(req).prefix), "/")
+	if len(parts) == 3 && parts[1] == "e" && parts[2] != "" {
+		return parts[2], true
+	}
+	return "", false
+}
@@ -0,0 +1,39 @@
+package paths
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+)
+
+// TestBlobBoundToVideo checks that a blob only decrypts for the video it
+// was made for, and is rejected when replayed on another ID.
+func TestBlobBoundToVideo(t *testing.T) {
+	t.Setenv("SECRET_KEY", "1234567890123456")
+	config.LoadConfig()
+
+	blob, err := EncryptInstructions("dQw4w9WgXcQ", "width=320", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := decryptInstructions("dQw4w9WgXcQ", blob)
+	if err != nil {
+		t.Fatalf("decrypting for the same video: %v", err)
+	}
+	if got := query.Get("width"); got != "320" {
+		t.Errorf("width = %q, want 320", got)
+	}
+
+	other, err := EncodeID("jNQXAC9IVRw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	Vi(w, httptest.NewRequest("GET", "/vi/"+other+"/e/"+blob, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("replayed blob: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
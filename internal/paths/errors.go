@@ -0,0 +1,43 @@
+package paths
+
+import (
+	"encoding/xml"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ossError is the XML error body returned by Alibaba OSS.
+type ossError struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	RequestId string   `xml:"RequestId"`
+	HostId    string   `xml:"HostId"`
+}
+
+// writeOSSError sends an error the way Alibaba OSS does, so clients built
+// for OSS can handle it.
+func writeOSSError(w http.ResponseWriter, req *http.Request, status int, code, message string) {
+	requestId := generateRequestID()
+	body, _ := xml.MarshalIndent(ossError{
+		Code:      code,
+		Message:   message,
+		RequestId: requestId,
+		HostId:    req.Host,
+	}, "", "  ")
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-OSS-Request-Id", requestId)
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// writeThrottled answers a request that exceeded its rate limit.
+func writeThrottled(w http.ResponseWriter, req *http.Request, retry time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	writeOSSError(w, req, http.StatusTooManyRequests, "Throttling", "Request rate exceeded, please retry later.")
+}
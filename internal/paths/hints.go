@@ -0,0 +1,103 @@
+package paths
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// acceptCH lists the Client Hints advertised on every image response.
+// Save-Data is not requested, browsers send it whenever the user enabled it.
+const acceptCH = "Sec-CH-DPR, Sec-CH-Width, Sec-CH-Viewport-Width"
+
+// advertiseClientHints asks browsers to send the hints used by width=auto
+// and dpr=auto on later requests.
+func advertiseClientHints(w http.ResponseWriter) {
+	if config.Cfg.Client_hints.Enabled {
+		w.Header().Set("Accept-CH", acceptCH)
+	}
+}
+
+// applyClientHints resolves width=auto and dpr=auto from the request
+// headers and adds every hint it consulted, present or not, to Vary.
+//
+// An automatic width is Sec-CH-Width, which is already in device pixels,
+// or else Sec-CH-Viewport-Width times Sec-CH-DPR, rounded up to the next
+// breakpoint. An automatic ratio is Sec-CH-DPR rounded up to a multiple of
+// 0.5 and capped at MAX_DPR. Save-Data lowers the default quality of
+// either for lossy formats. Without hints the options are left as if auto was not given.
+func applyClientHints(w http.ResponseWriter, header http.Header, o *imageOptions) {
+	if !o.AutoWidth && !o.AutoDPR {
+		return
+	}
+	if !config.Cfg.Client_hints.Enabled {
+		o.AutoWidth, o.AutoDPR = false, false
+		return
+	}
+
+	var vary []string
+	if o.AutoWidth {
+		vary = append(vary, "Sec-CH-Width", "Sec-CH-Viewport-Width", "Sec-CH-DPR")
+		width := hintValue(header, "Sec-CH-Width")
+		if width == 0 {
+			dpr := hintValue(header, "Sec-CH-DPR")
+			if dpr == 0 {
+				dpr = 1
+			}
+			width = hintValue(header, "Sec-CH-Viewport-Width") * min(dpr, config.Cfg.Limits.Max_dpr)
+		}
+		if width > 0 {
+			o.Width = breakpoint(int(math.Ceil(width)))
+			metrics.Inc("client_hints_width")
+		}
+	} else {
+		vary = append(vary, "Sec-CH-DPR")
+		if dpr := hintValue(header, "Sec-CH-DPR"); dpr > 0 {
+			dpr = min(math.Ceil(dpr*2)/2, config.Cfg.Limits.Max_dpr)
+			o.Width = scaleDimension(o.Width, dpr)
+			o.Height = scaleDimension(o.Height, dpr)
+			metrics.Inc("client_hints_dpr")
+		}
+	}
+
+	if o.Quality == defaultQuality && lossyFormat(o.Format) {
+		vary = append(vary, "Save-Data")
+		if strings.EqualFold(strings.TrimSpace(header.Get("Save-Data")), "on") {
+			o.Quality = config.Cfg.Client_hints.Save_data_quality
+			metrics.Inc("client_hints_save_data")
+		}
+	}
+
+	if o.Width == 0 && o.Height == 0 {
+		o.Filter = defaultFilter
+	}
+	w.Header().Add("Vary", strings.Join(vary, ", "))
+}
+
+// hintValue parses a numeric hint, returning 0 if it is missing or invalid.
+func hintValue(header http.Header, name string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(header.Get(name)), 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) {
+		return 0
+	}
+	return v
+}
+
+// breakpoint rounds a width up to the next configured breakpoint, or down
+// to the largest one if it is wider than all of them.
+func breakpoint(width int) int {
+	breakpoints := config.Cfg.Client_hints.Breakpoint_list
+	if len(breakpoints) == 0 {
+		return width
+	}
+	for _, bp := range breakpoints {
+		if bp >= width {
+			return bp
+		}
+	}
+	return breakpoints[len(breakpoints)-1]
+}
@@ -0,0 +1,201 @@
+package paths
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The v2 encoded ID is 16 base64-url characters: the 66 bits of the
+// YouTube ID passed through a keyed Feistel permutation (11 characters),
+// followed by a 30 bit truncated HMAC of the ID (5 characters). Unlike v1,
+// a random or tampered ID fails the MAC check instead of decoding to some
+// other video, and known plaintext/ciphertext pairs do not reveal the key.
+const (
+	expectedV2Len = 16
+	expiringV2Len = 22
+	expiryLen     = 6
+	v2MacLen      = 5
+	feistelRounds = 8
+	halfBits      = 33
+	halfMask      = 1<<halfBits - 1
+	base64urlSet  = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+var errInvalidMac = errors.New("authentication failed")
+var errExpired = errors.New("expired")
+
+// deriveSubkey derives an independent key for one purpose from the secret.
+func deriveSubkey(secret, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// splitID turns an 11 character ID into the two 33 bit halves of its
+// 66 bit value.
+func splitID(id string) (l, r uint64) {
+	for i := 0; i < len(id); i++ {
+		v := uint64(strings.IndexByte(base64urlSet, id[i]))
+		for b := 5; b >= 0; b-- {
+			bit := (v >> b) & 1
+			if i*6+(5-b) < halfBits {
+				l = l<<1 | bit
+			} else {
+				r = r<<1 | bit
+			}
+		}
+	}
+	return l, r
+}
+
+// joinID is the inverse of splitID.
+func joinID(l, r uint64) string {
+	out := make([]byte, expectedInputLen)
+	for i := range out {
+		var v uint64
+		for b := 0; b < 6; b++ {
+			pos := i*6 + b
+			var bit uint64
+			if pos < halfBits {
+				bit = (l >> (halfBits - 1 - pos)) & 1
+			} else {
+				bit = (r >> (2*halfBits - 1 - pos)) & 1
+			}
+			v = v<<1 | bit
+		}
+		out[i] = base64urlSet[v]
+	}
+	return string(out)
+}
+
+// feistelRound is the round function, a keyed PRF truncated to 33 bits.
+func feistelRound(key []byte, round int, half uint64) uint64 {
+	var buf [9]byte
+	buf[0] = byte(round)
+	binary.BigEndian.PutUint64(buf[1:], half)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & halfMask
+}
+
+func permute(key []byte, id string) string {
+	l, r := splitID(id)
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^feistelRound(key, i, r)
+	}
+	return joinID(l, r)
+}
+
+func unpermute(key []byte, id string) string {
+	l, r := splitID(id)
+	for i := feistelRounds - 1; i >= 0; i-- {
+		l, r = r^feistelRound(key, i, l), l
+	}
+	return joinID(l, r)
+}
+
+// idMac returns the truncated MAC of a decoded ID as base64-url characters.
+// The domain keeps MACs of different ID variants apart.
+func idMac(key []byte, domain, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(domain))
+	mac.Write([]byte(id))
+	sum := mac.Sum(nil)
+
+	out := make([]byte, v2MacLen)
+	bits := binary.BigEndian.Uint64(sum)
+	for i := range out {
+		out[i] = base64urlSet[(bits>>(58-6*i))&63]
+	}
+	return string(out)
+}
+
+// EncodeV2 converts an 11-character YouTube ID to a 16-character
+// authenticated encoded ID.
+func EncodeV2(id11, secret string) (string, error) {
+	if err := validateID(id11, expectedInputLen); err != nil {
+		return "", fmt.Errorf("invalid input ID: %w", err)
+	}
+	prp := deriveSubkey(secret, "thumbs-v2-prp")
+	mac := deriveSubkey(secret, "thumbs-v2-mac")
+	return permute(prp, id11) + idMac(mac, "v2:", id11), nil
+}
+
+// DecodeV2 converts a 16-character encoded ID back to an 11-character
+// YouTube ID. It fails if the MAC does not match.
+func DecodeV2(id16, secret string) (string, error) {
+	if err := validateID(id16, expectedV2Len); err != nil {
+		return "", fmt.Errorf("invalid input ID: %w", err)
+	}
+	prp := deriveSubkey(secret, "thumbs-v2-prp")
+	mac := deriveSubkey(secret, "thumbs-v2-mac")
+
+	id11 := unpermute(prp, id16[:expectedInputLen])
+	if !hmac.Equal([]byte(idMac(mac, "v2:", id11)), []byte(id16[expectedInputLen:])) {
+		return "", errInvalidMac
+	}
+	return id11, nil
+}
+
+// The expiring variant is 22 characters: the permuted ID (11 characters),
+// the expiry as Unix seconds (6 characters, 36 bits) and a MAC over both
+// (5 characters). The expiry is not secret, only authenticated.
+
+func encodeUint(v uint64, n int) string {
+	out := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		out[i] = base64urlSet[v&63]
+		v >>= 6
+	}
+	return string(out)
+}
+
+func decodeUint(s string) uint64 {
+	var v uint64
+	for i := 0; i < len(s); i++ {
+		v = v<<6 | uint64(strings.IndexByte(base64urlSet, s[i]))
+	}
+	return v
+}
+
+// EncodeV2Expiring converts an 11-character YouTube ID to a 22-character
+// encoded ID that stops working after expires.
+func EncodeV2Expiring(id11, secret string, expires time.Time) (string, error) {
+	if err := validateID(id11, expectedInputLen); err != nil {
+		return "", fmt.Errorf("invalid input ID: %w", err)
+	}
+	if expires.Unix() <= 0 || expires.Unix() >= 1<<(6*expiryLen) {
+		return "", fmt.Errorf("expiry out of range")
+	}
+	prp := deriveSubkey(secret, "thumbs-v2-prp")
+	mac := deriveSubkey(secret, "thumbs-v2-mac")
+	expiry := encodeUint(uint64(expires.Unix()), expiryLen)
+	return permute(prp, id11) + expiry + idMac(mac, "v2e:", id11+expiry), nil
+}
+
+// DecodeV2Expiring converts a 22-character encoded ID back to an
+// 11-character YouTube ID and its expiry. It fails if the MAC does not
+// match, and returns errExpired once the expiry has passed.
+func DecodeV2Expiring(id22, secret string) (string, time.Time, error) {
+	if err := validateID(id22, expiringV2Len); err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid input ID: %w", err)
+	}
+	prp := deriveSubkey(secret, "thumbs-v2-prp")
+	mac := deriveSubkey(secret, "thumbs-v2-mac")
+
+	id11 := unpermute(prp, id22[:expectedInputLen])
+	expiry := id22[expectedInputLen : expectedInputLen+expiryLen]
+	if !hmac.Equal([]byte(idMac(mac, "v2e:", id11+expiry)), []byte(id22[expectedInputLen+expiryLen:])) {
+		return "", time.Time{}, errInvalidMac
+	}
+	expires := time.Unix(int64(decodeUint(expiry)), 0)
+	if time.Now().After(expires) {
+		return id11, expires, errExpired
+	}
+	return id11, expires, nil
+}
@@ -0,0 +1,120 @@
+package paths
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// ErrExpired is returned for an authentic ID whose expiry has passed.
+var ErrExpired = errExpired
+
+// decodedID is the result of decoding an encoded ID.
+type decodedID struct {
+	VideoId string
+	KeyId   string
+	// Expires is zero unless the ID is an expiring one.
+	Expires time.Time
+}
+
+// EncodeID converts an 11-character YouTube ID to a v2 encoded ID using
+// the primary key of the keyring.
+func EncodeID(id11 string) (string, error) {
+	key := config.Cfg.Companion.Keys[0]
+	metrics.Inc("key_encodes_" + key.Id)
+	return EncodeV2(id11, key.Secret)
+}
+
+// EncodeExpiringID converts an 11-character YouTube ID to an expiring v2
+// encoded ID using the primary key of the keyring.
+func EncodeExpiringID(id11 string, expires time.Time) (string, error) {
+	key := config.Cfg.Companion.Keys[0]
+	metrics.Inc("key_encodes_" + key.Id)
+	return EncodeV2Expiring(id11, key.Secret, expires)
+}
+
+// ParseExpiry turns either an absolute Unix timestamp or a relative
+// duration ("3600" seconds or "24h") into an expiry time. Both empty means
+// no expiry and returns the zero time.
+func ParseExpiry(expires, expiresIn string) (time.Time, error) {
+	if expires != "" {
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expires '%s': expected a Unix timestamp", expires)
+		}
+		return time.Unix(unix, 0), nil
+	}
+	if expiresIn != "" {
+		if seconds, err := strconv.Atoi(expiresIn); err == nil {
+			return time.Now().Add(time.Duration(seconds) * time.Second), nil
+		}
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expires_in '%s': expected seconds or a duration like 24h", expiresIn)
+		}
+		return time.Now().Add(d), nil
+	}
+	return time.Time{}, nil
+}
+
+// decodeID decodes an encoded ID of any supported version. An expired ID
+// returns errExpired, but only after its MAC has been verified.
+//
+// v2 IDs do not embed the key ID, it is derived by finding the key whose
+// MAC matches, trying the primary key first. v1 IDs cannot be
+// authenticated, so they are always decoded with V1_SECRET_KEY_ID and
+// only while ALLOW_V1_IDS is enabled.
+func decodeID(encoded string) (decodedID, error) {
+	keys := config.Cfg.Companion.Keys
+
+	switch len(encoded) {
+	case expectedV2Len, expiringV2Len:
+		for _, key := range keys {
+			var d decodedID
+			var err error
+			if len(encoded) == expectedV2Len {
+				d.VideoId, err = DecodeV2(encoded, key.Secret)
+			} else {
+				d.VideoId, d.Expires, err = DecodeV2Expiring(encoded, key.Secret)
+			}
+			if errors.Is(err, errInvalidMac) {
+				continue
+			}
+			if err != nil && !errors.Is(err, errExpired) {
+				return decodedID{}, err
+			}
+			d.KeyId = key.Id
+			metrics.Inc("key_decodes_" + key.Id)
+			return d, err
+		}
+		return decodedID{}, errInvalidMac
+	case expectedOutputLen:
+		if !config.Cfg.Companion.Allow_v1_ids {
+			return decodedID{}, fmt.Errorf("v1 encoded IDs are disabled")
+		}
+		for _, key := range keys {
+			if key.Id != config.Cfg.Companion.V1_key_id {
+				continue
+			}
+			videoId, err := Decode(encoded, key.Secret)
+			if err != nil {
+				return decodedID{}, err
+			}
+			metrics.Inc("key_decodes_" + key.Id)
+			return decodedID{VideoId: videoId, KeyId: key.Id}, nil
+		}
+	}
+	return decodedID{}, fmt.Errorf("invalid length: expected %d, %d or %d, got %d", expectedV2Len, expiringV2Len, expectedOutputLen, len(encoded))
+}
+
+// DecodeID decodes an encoded ID of any supported version for tools
+// outside the server. An expired ID returns ErrExpired along with its
+// video ID and expiry.
+func DecodeID(encoded string) (string, time.Time, error) {
+	d, err := decodeID(encoded)
+	return d.VideoId, d.Expires, err
+}
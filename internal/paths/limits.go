@@ -0,0 +1,81 @@
+package paths
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// Limits protect the processing pipeline from decompression bombs and
+// oversized requests. A limit of zero disables the check. Every violation
+// has its own error code.
+
+// readBody reads an upstream body, failing as soon as it is larger than
+// MAX_UPSTREAM_BODY instead of buffering all of it.
+func readBody(resp *http.Response) ([]byte, *requestError) {
+	limit := config.Cfg.Limits.Max_body
+	tooLarge := &requestError{
+		Status:  http.StatusBadGateway,
+		Code:    "UpstreamBodyTooLarge",
+		Message: fmt.Sprintf("The upstream image is larger than %d bytes.", limit),
+	}
+	if limit > 0 && resp.ContentLength > limit {
+		metrics.Inc("limit_body")
+		return nil, tooLarge
+	}
+
+	var r io.Reader = resp.Body
+	if limit > 0 {
+		r = io.LimitReader(resp.Body, limit+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &requestError{Status: http.StatusInternalServerError, Message: "Error reading image data"}
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		metrics.Inc("limit_body")
+		return nil, tooLarge
+	}
+	return data, nil
+}
+
+// checkSource checks the dimensions of a source image, read with
+// image.DecodeConfig before the image is decoded.
+func checkSource(width, height int) *requestError {
+	limit := config.Cfg.Limits.Max_source_pixels
+	if limit > 0 && int64(width)*int64(height) > limit {
+		metrics.Inc("limit_source_pixels")
+		return &requestError{
+			Status:  http.StatusBadGateway,
+			Code:    "SourceImageTooLarge",
+			Message: fmt.Sprintf("The source image has %dx%d pixels, more than the limit of %d.", width, height, limit),
+		}
+	}
+	return nil
+}
+
+// checkOutput checks the dimensions of a processed image. Unknown
+// dimensions are zero and always pass.
+func checkOutput(width, height int) *requestError {
+	c := config.Cfg.Limits
+	if (c.Max_width > 0 && width > c.Max_width) || (c.Max_height > 0 && height > c.Max_height) {
+		metrics.Inc("limit_output_dimensions")
+		return &requestError{
+			Status:  http.StatusBadRequest,
+			Code:    "OutputDimensionsTooLarge",
+			Message: fmt.Sprintf("The requested size %dx%d exceeds the maximum of %dx%d.", width, height, c.Max_width, c.Max_height),
+		}
+	}
+	if c.Max_output_pixels > 0 && int64(width)*int64(height) > c.Max_output_pixels {
+		metrics.Inc("limit_output_pixels")
+		return &requestError{
+			Status:  http.StatusBadRequest,
+			Code:    "OutputTooManyPixels",
+			Message: fmt.Sprintf("The requested size %dx%d exceeds the maximum of %d pixels.", width, height, c.Max_output_pixels),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package paths
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// minMaxBytesSide is the smallest width or height max_bytes downscales to.
+const minMaxBytesSide = 16
+
+// encodeMaxBytes encodes an image to fit in o.MaxBytes. It first looks for
+// the highest quality between MAX_BYTES_MIN_QUALITY and the requested one
+// that fits, with a binary search since the size grows with the quality.
+// If even the lowest quality is too large, the image is downscaled by the
+// estimated factor and searched again, up to MAX_BYTES_DOWNSCALES times.
+//
+// Lossless and paletted formats have no quality to trade, so they are
+// only downscaled.
+// The search works on any encoder behind encoder.encode, so real WebP or
+// AVIF encoders get it for free.
+func encodeMaxBytes(img image.Image, o imageOptions, enc encoder) (processedImage, error) {
+	c := config.Cfg.Max_bytes
+	lossy := lossyFormat(o.Format)
+	floor := min(c.Min_quality, o.Quality)
+
+	for downscales := 0; ; downscales++ {
+		// Try the requested quality first, most images fit as they are
+		body, contentType, err := encodeMaxBytesAt(enc, img, o.Quality)
+		if err != nil {
+			return processedImage{}, err
+		}
+		best := processedImage{Body: body, ContentType: contentType, Quality: o.Quality}
+		smallest := len(body)
+
+		if len(body) > o.MaxBytes && lossy && floor < o.Quality {
+			body, _, err = encodeMaxBytesAt(enc, img, floor)
+			if err != nil {
+				return processedImage{}, err
+			}
+			smallest = len(body)
+			if len(body) <= o.MaxBytes {
+				// floor fits and o.Quality does not, narrow the range
+				lo, hi := floor, o.Quality
+				best.Body, best.Quality = body, floor
+				for hi-lo > 1 {
+					mid := (lo + hi) / 2
+					body, _, err = encodeMaxBytesAt(enc, img, mid)
+					if err != nil {
+						return processedImage{}, err
+					}
+					if len(body) <= o.MaxBytes {
+						lo, best.Body, best.Quality = mid, body, mid
+					} else {
+						hi = mid
+					}
+				}
+			}
+		}
+
+		bounds := img.Bounds()
+		if len(best.Body) <= o.MaxBytes {
+			best.Width, best.Height = bounds.Dx(), bounds.Dy()
+			return best, nil
+		}
+
+		// The encoded size roughly follows the pixel count
+		factor := min(math.Sqrt(float64(o.MaxBytes)/float64(smallest))*0.95, 0.9)
+		width := int(math.Round(float64(bounds.Dx()) * factor))
+		height := int(math.Round(float64(bounds.Dy()) * factor))
+		if downscales >= c.Downscales || width < minMaxBytesSide || height < minMaxBytesSide {
+			metrics.Inc("max_bytes_unreachable")
+			return processedImage{}, &requestError{
+				Status:  http.StatusBadRequest,
+				Code:    "MaxBytesTooSmall",
+				Message: fmt.Sprintf("The image cannot be encoded in %d bytes, the smallest result was %d bytes.", o.MaxBytes, smallest),
+			}
+		}
+		metrics.Inc("max_bytes_downscales")
+		img = imaging.Resize(img, width, height, resampleFilters[o.Filter])
+	}
+}
+
+// encodeMaxBytesAt is encoder.encode, counting the attempts of the search.
+func encodeMaxBytesAt(enc encoder, img image.Image, quality int) ([]byte, string, error) {
+	metrics.Inc("max_bytes_encodes")
+	return enc.encode(img, quality)
+}
@@ -0,0 +1,449 @@
+package paths
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/watermark"
+)
+
+const (
+	defaultQuality = 85
+	defaultFormat  = "webp"
+	defaultFilter  = "lanczos"
+	defaultChroma  = "420"
+	// defaultMetadata strips processed images and leaves originals as
+	// they are, an explicit "strip" also strips originals.
+	defaultMetadata = ""
+)
+
+// imageOptions holds the processing instructions of a request. A device
+// pixel ratio is already applied to Width and Height.
+type imageOptions struct {
+	Width   int
+	Height  int
+	Quality int
+	Format  string
+	// Filter is the resampling filter, one of the keys of resampleFilters.
+	Filter string
+	// Sharpen is the OSS sharpen amount, 50-399, or 0 for none.
+	Sharpen int
+	// MaxBytes is the byte budget of the encoded image, or 0 for none.
+	MaxBytes int
+	// Interlace, Chroma and Metadata only apply to JPEG encoding. Chroma
+	// is one of the keys of chromaSubsampling, Metadata is "strip", "icc"
+	// or "keep" (ICC profile and EXIF), or empty for the default.
+	Interlace bool
+	Chroma    string
+	Metadata  string
+	// Colors and Dither only apply to the paletted formats, png8 and gif.
+	Colors int
+	Dither bool
+	// Watermark is drawn after resizing and sharpening, if not empty.
+	Watermark watermark.Options
+	// AutoWidth and AutoDPR ask for the width or the device pixel ratio to
+	// be taken from Client Hints. applyClientHints resolves them into the
+	// fields above, so they are not part of the cache key.
+	AutoWidth bool
+	AutoDPR   bool
+}
+
+// needsProcessing reports whether the original image can be served as is.
+func (o imageOptions) needsProcessing() bool {
+	return o.changesImage() || o.Metadata == "strip"
+}
+
+// changesImage reports whether the options change the pixels or the
+// encoding of the original image. Stripping the metadata of an original
+// alone does not, it only drops segments of the JPEG file.
+func (o imageOptions) changesImage() bool {
+	return o.Width > 0 || o.Height > 0 || o.Format != defaultFormat || o.Quality != defaultQuality || o.Sharpen > 0 || o.MaxBytes > 0 ||
+		o.Interlace || o.Chroma != defaultChroma || !o.Watermark.Empty()
+}
+
+// small reports whether the output is small enough for the priority lane
+// of the processing pool. Missing dimensions are estimated from the 16:9
+// aspect ratio of YouTube thumbnails, and no dimensions at all means the
+// full size source.
+func (o imageOptions) small() bool {
+	w, h := o.Width, o.Height
+	switch {
+	case w > 0 && h == 0:
+		h = w * 9 / 16
+	case h > 0 && w == 0:
+		w = h * 16 / 9
+	case w == 0 && h == 0:
+		return false
+	}
+	return w*h <= config.Cfg.Processing.Small_pixels
+}
+
+// canonical returns a stable representation of the options, used as the
+// cache key of a variant. The unprocessed original is the empty string.
+func (o imageOptions) canonical() string {
+	if !o.needsProcessing() {
+		return ""
+	}
+	key := fmt.Sprintf("w_%d,h_%d,q_%d,f_%s", o.Width, o.Height, o.Quality, o.Format)
+	if o.Filter != defaultFilter {
+		key += ",fl_" + o.Filter
+	}
+	if o.Sharpen > 0 {
+		key += fmt.Sprintf(",sh_%d", o.Sharpen)
+	}
+	if o.MaxBytes > 0 {
+		key += fmt.Sprintf(",mb_%d", o.MaxBytes)
+	}
+	if o.Interlace {
+		key += ",il_1"
+	}
+	if o.Chroma != defaultChroma {
+		key += ",cs_" + o.Chroma
+	}
+	if o.Metadata != defaultMetadata {
+		key += ",md_" + o.Metadata
+	}
+	if palettedFormat(o.Format) {
+		key += fmt.Sprintf(",c_%d,d_%t", o.Colors, o.Dither)
+	}
+	if !o.Watermark.Empty() {
+		key += ",wm_" + watermarkKey(o.Watermark)
+	}
+	return key
+}
+
+// query returns the options as direct parameters, for forwarding options
+// resolved from request headers to a peer.
+func (o imageOptions) query() string {
+	query := url.Values{}
+	if o.Width > 0 {
+		query.Set("width", strconv.Itoa(o.Width))
+	}
+	if o.Height > 0 {
+		query.Set("height", strconv.Itoa(o.Height))
+	}
+	query.Set("quality", strconv.Itoa(o.Quality))
+	query.Set("format", o.Format)
+	query.Set("filter", o.Filter)
+	if o.Sharpen > 0 {
+		query.Set("sharpen", strconv.Itoa(o.Sharpen))
+	}
+	if o.MaxBytes > 0 {
+		query.Set("max_bytes", strconv.Itoa(o.MaxBytes))
+	}
+	if o.Interlace {
+		query.Set("interlace", "1")
+	}
+	query.Set("chroma", o.Chroma)
+	if o.Metadata != defaultMetadata {
+		query.Set("metadata", o.Metadata)
+	}
+	if palettedFormat(o.Format) {
+		query.Set("colors", strconv.Itoa(o.Colors))
+		query.Set("dither", strconv.FormatBool(o.Dither))
+	}
+	if !o.Watermark.Empty() {
+		query.Set("watermark", o.Watermark.String())
+	}
+	return query.Encode()
+}
+
+func parseFormat(s string) string {
+	switch strings.ToLower(s) {
+	case "jpg", "jpeg":
+		return "jpeg"
+	case "png":
+		return "png"
+	case "png8":
+		return "png8"
+	case "gif":
+		return "gif"
+	case "bmp":
+		return "bmp"
+	case "tif", "tiff":
+		return "tiff"
+	case "webp":
+		return "webp"
+	case "avif":
+		return "avif"
+	}
+	return ""
+}
+
+func parseFilter(s string) string {
+	s = strings.ToLower(s)
+	if _, ok := resampleFilters[s]; ok {
+		return s
+	}
+	return ""
+}
+
+// parseDPR accepts a positive device pixel ratio, capped at MAX_DPR.
+func parseDPR(s string) float64 {
+	dpr, err := strconv.ParseFloat(s, 64)
+	if err != nil || dpr <= 0 || math.IsInf(dpr, 0) {
+		return 0
+	}
+	return min(dpr, config.Cfg.Limits.Max_dpr)
+}
+
+// parseSharpen accepts the OSS sharpen range of 50 to 399.
+func parseSharpen(s string) int {
+	if v, err := strconv.Atoi(s); err == nil && v >= 50 && v <= 399 {
+		return v
+	}
+	return 0
+}
+
+func parseMaxBytes(s string) int {
+	if v, err := strconv.Atoi(s); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}
+
+func parseChroma(s string) string {
+	if _, ok := chromaSubsampling[s]; ok {
+		return s
+	}
+	return ""
+}
+
+func parseMetadata(s string) string {
+	switch s = strings.ToLower(s); s {
+	case "strip", "icc", "keep":
+		return s
+	}
+	return ""
+}
+
+// parseColors accepts a palette size of 2 to 256.
+func parseColors(s string) int {
+	if v, err := strconv.Atoi(s); err == nil && v >= 2 && v <= 256 {
+		return v
+	}
+	return 0
+}
+
+// scaleDimension applies a device pixel ratio to a requested dimension.
+func scaleDimension(v int, dpr float64) int {
+	if v == 0 {
+		return 0
+	}
+	return max(1, int(math.Round(float64(v)*dpr)))
+}
+
+// parseOptions reads Alibaba-style processing parameters, falling back to
+// direct parameters for anything x-oss-process did not set.
+func parseOptions(query url.Values) imageOptions {
+	o := imageOptions{
+		Quality:  defaultQuality,
+		Format:   defaultFormat,
+		Filter:   defaultFilter,
+		Chroma:   defaultChroma,
+		Metadata: defaultMetadata,
+		Colors:   config.Cfg.Palette.Colors,
+		Dither:   config.Cfg.Palette.Dither,
+	}
+	interlace, dither := "", ""
+	var dpr float64
+
+	// Check for x-oss-process parameter (Alibaba format)
+	if ossProcess := query.Get("x-oss-process"); ossProcess != "" {
+		// Parse Alibaba-style parameters: x-oss-process=image/resize,w_320,h_160/format,jpg/quality,q_90
+		// Thumbs adds filter_ and dpr_ to resize: image/resize,w_320,filter_catmullrom,dpr_2
+		// and w_auto and dpr_auto for Client Hints
+		if strings.HasPrefix(ossProcess, "image/") {
+			operations := strings.Split(ossProcess[6:], "/") // Remove "image/" prefix
+			for _, op := range operations {
+				if strings.HasPrefix(op, "resize,") {
+					// Parse resize parameters: resize,w_320,h_160
+					params := strings.Split(op[7:], ",") // Remove "resize," prefix
+					for _, param := range params {
+						if param == "w_auto" {
+							o.AutoWidth = true
+						} else if param == "dpr_auto" {
+							o.AutoDPR = true
+						} else if strings.HasPrefix(param, "w_") {
+							if w, err := strconv.Atoi(param[2:]); err == nil && w > 0 {
+								o.Width = w
+							}
+						} else if strings.HasPrefix(param, "h_") {
+							if h, err := strconv.Atoi(param[2:]); err == nil && h > 0 {
+								o.Height = h
+							}
+						} else if strings.HasPrefix(param, "filter_") {
+							if f := parseFilter(param[7:]); f != "" {
+								o.Filter = f
+							}
+						} else if strings.HasPrefix(param, "dpr_") {
+							dpr = parseDPR(param[4:])
+						}
+					}
+				} else if strings.HasPrefix(op, "format,") {
+					// Parse format parameter: format,jpg
+					if f := parseFormat(op[7:]); f != "" {
+						o.Format = f
+					}
+				} else if strings.HasPrefix(op, "quality,") {
+					// Parse quality parameter: quality,q_90
+					qualityParam := op[8:] // Remove "quality," prefix
+					// Support numeric quality directly as well
+					qualityParam = strings.TrimPrefix(qualityParam, "q_")
+					if q, err := strconv.Atoi(qualityParam); err == nil && q >= 1 && q <= 100 {
+						o.Quality = q
+					}
+				} else if strings.HasPrefix(op, "sharpen,") {
+					// Parse sharpen parameter: sharpen,100
+					o.Sharpen = parseSharpen(op[8:])
+				} else if strings.HasPrefix(op, "max_bytes,") {
+					// Parse byte budget: max_bytes,20000
+					o.MaxBytes = parseMaxBytes(op[10:])
+				} else if strings.HasPrefix(op, "interlace,") {
+					// Parse progressive JPEG: interlace,1
+					interlace = op[10:]
+				} else if strings.HasPrefix(op, "chroma,") {
+					// Parse chroma subsampling: chroma,444
+					if c := parseChroma(op[7:]); c != "" {
+						o.Chroma = c
+					}
+				} else if strings.HasPrefix(op, "metadata,") {
+					// Parse metadata handling: metadata,keep
+					if m := parseMetadata(op[9:]); m != "" {
+						o.Metadata = m
+					}
+				} else if strings.HasPrefix(op, "colors,") {
+					// Parse palette size: colors,64
+					if c := parseColors(op[7:]); c != 0 {
+						o.Colors = c
+					}
+				} else if strings.HasPrefix(op, "dither,") {
+					// Parse dithering: dither,0
+					dither = op[7:]
+				} else if strings.HasPrefix(op, "watermark,") {
+					// Parse watermark: watermark,text_SGVsbG8,g_se,t_50
+					o.Watermark = parseWatermark(op[10:])
+				}
+			}
+		}
+	}
+
+	// Check for direct parameters (fallback/alternative)
+	if o.Width == 0 && o.Height == 0 && !o.AutoWidth {
+		o.AutoWidth = query.Get("width") == "auto"
+		if width, err := strconv.Atoi(query.Get("width")); err == nil && width > 0 {
+			o.Width = width
+		}
+		if height, err := strconv.Atoi(query.Get("height")); err == nil && height > 0 {
+			o.Height = height
+		}
+	}
+
+	if o.Quality == defaultQuality {
+		qualityStr := query.Get("quality")
+		if qualityStr == "" {
+			// Support Alibaba-style quality parameter
+			qualityStr = query.Get("q")
+		}
+		if q, err := strconv.Atoi(qualityStr); err == nil && q >= 1 && q <= 100 {
+			o.Quality = q
+		}
+	}
+
+	if o.Format == defaultFormat {
+		if f := parseFormat(query.Get("format")); f != "" {
+			o.Format = f
+		}
+	}
+
+	if o.Filter == defaultFilter {
+		if f := parseFilter(query.Get("filter")); f != "" {
+			o.Filter = f
+		}
+	}
+
+	if dpr == 0 && !o.AutoDPR {
+		if query.Get("dpr") == "auto" {
+			o.AutoDPR = true
+		} else {
+			dpr = parseDPR(query.Get("dpr"))
+		}
+	}
+	if dpr > 0 {
+		o.Width = scaleDimension(o.Width, dpr)
+		o.Height = scaleDimension(o.Height, dpr)
+	}
+
+	if o.Sharpen == 0 {
+		o.Sharpen = parseSharpen(query.Get("sharpen"))
+	}
+
+	if o.MaxBytes == 0 {
+		o.MaxBytes = parseMaxBytes(query.Get("max_bytes"))
+	}
+
+	if interlace == "" {
+		interlace = query.Get("interlace")
+	}
+	o.Interlace = interlace == "1"
+
+	if o.Chroma == defaultChroma {
+		if c := parseChroma(query.Get("chroma")); c != "" {
+			o.Chroma = c
+		}
+	}
+
+	if o.Metadata == defaultMetadata {
+		if m := parseMetadata(query.Get("metadata")); m != "" {
+			o.Metadata = m
+		}
+	}
+
+	if o.Colors == config.Cfg.Palette.Colors {
+		if c := parseColors(query.Get("colors")); c != 0 {
+			o.Colors = c
+		}
+	}
+
+	if dither == "" {
+		dither = query.Get("dither")
+	}
+	if d, err := strconv.ParseBool(dither); err == nil {
+		o.Dither = d
+	}
+
+	if o.Watermark.Empty() {
+		o.Watermark = parseWatermark(query.Get("watermark"))
+	}
+
+	// Options of other encoders do not split the cache
+	if !lossyFormat(o.Format) {
+		o.Quality = defaultQuality
+		o.Interlace = false
+		o.Chroma = defaultChroma
+		o.Metadata = defaultMetadata
+	}
+
+	// Processed images are stripped anyway, so an explicit strip only
+	// splits the cache for the original
+	if o.Metadata == "strip" && (o.changesImage() || o.AutoWidth) {
+		o.Metadata = defaultMetadata
+	}
+
+	// An automatic width keeps the aspect ratio
+	if o.AutoWidth {
+		o.Width, o.Height = 0, 0
+	}
+
+	// The filter only matters when resizing, so it does not split the
+	// cache for unresized variants
+	if o.Width == 0 && o.Height == 0 && !o.AutoWidth {
+		o.Filter = defaultFilter
+	}
+
+	return o
+}
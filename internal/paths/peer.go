@@ -0,0 +1,82 @@
+package paths
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/javadalmasi/Thumbs/internal/cache"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+	"github.com/javadalmasi/Thumbs/internal/peers"
+)
+
+// fetchFromPeer asks the peer owning a variant for a thumbnail. It
+// returns nil if this instance owns the variant or the peer could not be
+// reached, in which case the caller goes to YouTube itself.
+func fetchFromPeer(videoId, transform, rawQuery string) *cache.Entry {
+	key := cache.Key(videoId, transform)
+	owner, remote := peers.Owner(key)
+	if !remote {
+		return nil
+	}
+
+	e, err := peers.Fetch(owner, videoId, transform, rawQuery)
+	if err != nil {
+		metrics.Inc("peer_errors")
+		log.Printf("[ERROR] [peers] Failed to fetch %s from '%s': %s\n", videoId, owner, err)
+		return nil
+	}
+	metrics.Inc("peer_fetches")
+
+	// Only keep a local replica of keys that are hot on this instance,
+	// everything else stays on the owner
+	if peers.Hot(key) {
+		metrics.Inc("peer_hot_replicas")
+		cache.Set(e)
+	}
+	return e
+}
+
+// PeerVi serves a thumbnail by decoded video ID to another Thumbs
+// instance. The owner never forwards the request again, even if its view
+// of the ring differs, so requests cannot loop between peers.
+func PeerVi(w http.ResponseWriter, req *http.Request) {
+	videoId := strings.TrimPrefix(req.URL.Path, "/_peer/vi/")
+	if err := validateID(videoId, expectedInputLen); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Invalid video ID: "+err.Error())
+		return
+	}
+
+	opts := parseOptions(req.URL.Query())
+	e := cache.Get(videoId, opts.canonical())
+	if e == nil {
+		var rerr *requestError
+		e, rerr = loadImage("GET", videoId, opts)
+		if rerr != nil {
+			rerr.write(w, req)
+			return
+		}
+		cache.Set(e)
+	}
+	peers.WriteEntry(w, e)
+}
+
+// PeerPurge drops a video, or with a transform one of its variants, from
+// the local cache on behalf of another peer.
+func PeerPurge(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	videoId := query.Get("video_id")
+	if err := validateID(videoId, expectedInputLen); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Invalid video ID: "+err.Error())
+		return
+	}
+	if query.Has("transform") {
+		cache.PurgeVariant(videoId, query.Get("transform"))
+	} else {
+		purgeLocal(videoId)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package paths
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+)
+
+// ID policies decide which kinds of IDs /vi/ accepts: "encoded" (v2 and
+// v1 encoded IDs), "raw" (plain 11-character YouTube IDs) or "both". A
+// route prefix policy wins over the listener policy, which wins over
+// ID_POLICY.
+const (
+	IDPolicyEncoded = "encoded"
+	IDPolicyRaw     = "raw"
+	IDPolicyBoth    = "both"
+)
+
+type viRouteKey struct{}
+type listenerPolicyKey struct{}
+
+// viRoute is the prefix and policy of the route serving a request.
+type viRoute struct {
+	prefix string
+	policy string
+}
+
+// WithIDPolicy applies an ID policy to every request served by a
+// listener.
+func WithIDPolicy(h http.Handler, policy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), listenerPolicyKey{}, policy)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// ViRoute serves /vi/ below another prefix with its own ID policy.
+func ViRoute(prefix, policy string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), viRouteKey{}, viRoute{prefix, policy})
+		Vi(w, req.WithContext(ctx))
+	}
+}
+
+// routeOf returns the prefix and ID policy that apply to a request.
+func routeOf(req *http.Request) viRoute {
+	if route, ok := req.Context().Value(viRouteKey{}).(viRoute); ok {
+		return route
+	}
+	route := viRoute{"/vi/", config.Cfg.Id_policy.Default}
+	if policy, ok := req.Context().Value(listenerPolicyKey{}).(string); ok {
+		route.policy = policy
+	}
+	return route
+}
+
+func (r viRoute) allowsRaw() bool {
+	return r.policy == IDPolicyRaw || r.policy == IDPolicyBoth
+}
+
+func (r viRoute) allowsEncoded() bool {
+	return r.policy == IDPolicyEncoded || r.policy == IDPolicyBoth
+}
@@ -0,0 +1,37 @@
+package paths
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/javadalmasi/Thumbs/internal/availability"
+	"github.com/javadalmasi/Thumbs/internal/httpc"
+)
+
+// ProbeMaxres checks with a HEAD request whether YouTube has generated
+// the maxresdefault rendition for a video.
+func ProbeMaxres(videoId string) (bool, error) {
+	imageURL := fmt.Sprintf("https://i.ytimg.com/vi/%s/maxresdefault.jpg", videoId)
+	request, err := http.NewRequest("HEAD", imageURL, nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("User-Agent", default_ua)
+
+	resp, err := httpc.Client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		availability.Set(videoId, "maxresdefault.jpg", true)
+		return true, nil
+	case 404:
+		availability.Set(videoId, "maxresdefault.jpg", false)
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,225 @@
+package paths
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	"image/png"
+
+	"github.com/disintegration/imaging"
+	"github.com/javadalmasi/Thumbs/internal/jpegenc"
+	"github.com/javadalmasi/Thumbs/internal/jpegscale"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+	"github.com/javadalmasi/Thumbs/internal/quantize"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// resampleFilters maps the filter option to the resampling filter.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"lanczos":    imaging.Lanczos,
+}
+
+// chromaSubsampling maps the chroma option to the JPEG subsampling.
+var chromaSubsampling = map[string]jpegenc.Subsampling{
+	"420": jpegenc.Subsample420,
+	"422": jpegenc.Subsample422,
+	"444": jpegenc.Subsample444,
+}
+
+// shrinkMargin is how many times larger than the target a JPEG must stay
+// after a scaled decode. Decoding at 1/8 straight to the target size would
+// alias, so the final Lanczos pass always gets at least twice the pixels.
+const shrinkMargin = 2
+
+// shrinkOnLoadScale returns the largest JPEG DCT scale, 8, 4 or 2, that
+// keeps the decoded image at least shrinkMargin times the output size in
+// both dimensions, or 1 if the image should be decoded at full size.
+func shrinkOnLoadScale(format string, cfg image.Config, width, height int) int {
+	if format != "jpeg" {
+		return 1
+	}
+	for _, scale := range []int{8, 4, 2} {
+		if cfg.Width/scale >= shrinkMargin*width && cfg.Height/scale >= shrinkMargin*height {
+			return scale
+		}
+	}
+	return 1
+}
+
+// processedImage is an encoded processing result.
+type processedImage struct {
+	Body        []byte
+	ContentType string
+	// Quality, Width and Height are the encoder settings that were used,
+	// which max_bytes may have lowered from the requested ones.
+	Quality int
+	Width   int
+	Height  int
+}
+
+// processImage decodes an upstream image, applies the requested options
+// and returns the encoded result.
+func processImage(imageData []byte, o imageOptions) (processedImage, error) {
+	// Read the dimensions first, so oversized images are never decoded
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(imageData))
+	if err != nil {
+		return processedImage{}, fmt.Errorf("Error decoding image: %v", err)
+	}
+	if rerr := checkSource(cfg.Width, cfg.Height); rerr != nil {
+		return processedImage{}, rerr
+	}
+
+	// Handle resize - if only one dimension is specified, calculate the other to maintain aspect ratio
+	var finalWidth, finalHeight int
+	origWidth := cfg.Width
+	origHeight := cfg.Height
+
+	if o.Width > 0 && o.Height > 0 {
+		// Both dimensions specified - resize to exact dimensions
+		finalWidth = o.Width
+		finalHeight = o.Height
+	} else if o.Width > 0 {
+		// Only width specified - calculate height to maintain aspect ratio
+		finalWidth = o.Width
+		finalHeight = int(float64(origHeight) * float64(o.Width) / float64(origWidth))
+	} else if o.Height > 0 {
+		// Only height specified - calculate width to maintain aspect ratio
+		finalHeight = o.Height
+		finalWidth = int(float64(origWidth) * float64(o.Height) / float64(origHeight))
+	} else {
+		// Neither specified - use original dimensions
+		finalWidth = origWidth
+		finalHeight = origHeight
+	}
+
+	if rerr := checkOutput(finalWidth, finalHeight); rerr != nil {
+		return processedImage{}, rerr
+	}
+
+	// Decode the image, JPEGs at the smallest DCT scale that still leaves
+	// the resize filter something to work with
+	var img image.Image
+	if scale := shrinkOnLoadScale(format, cfg, finalWidth, finalHeight); scale > 1 {
+		metrics.Inc("jpeg_scaled_decodes")
+		img, err = jpegscale.DecodeScaled(bytes.NewReader(imageData), scale)
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(imageData))
+	}
+	if err != nil {
+		return processedImage{}, fmt.Errorf("Error decoding image: %v", err)
+	}
+
+	// Resize the image
+	var resizedImg image.Image = imaging.Resize(img, finalWidth, finalHeight, resampleFilters[o.Filter])
+	if o.Sharpen > 0 {
+		// OSS sharpen amounts of 50-399 become unsharp mask sigmas of 0.5-4
+		resizedImg = imaging.Sharpen(resizedImg, float64(o.Sharpen)/100)
+	}
+	if resizedImg, err = applyWatermark(resizedImg, o.Watermark); err != nil {
+		return processedImage{}, err
+	}
+
+	enc := newEncoder(o, imageData, format)
+	if o.MaxBytes > 0 {
+		return encodeMaxBytes(resizedImg, o, enc)
+	}
+	body, contentType, err := enc.encode(resizedImg, o.Quality)
+	if err != nil {
+		return processedImage{}, err
+	}
+	return processedImage{Body: body, ContentType: contentType, Quality: o.Quality, Width: finalWidth, Height: finalHeight}, nil
+}
+
+// encoder holds the encoder settings of a request, except for the
+// quality that max_bytes searches.
+type encoder struct {
+	format string
+	jpeg   jpegenc.Options
+	// colors and dither apply to the paletted formats.
+	colors int
+	dither bool
+}
+
+// newEncoder prepares the encoder for a request. Metadata can only be
+// preserved from JPEG sources.
+func newEncoder(o imageOptions, source []byte, sourceFormat string) encoder {
+	e := encoder{format: o.Format, colors: o.Colors, dither: o.Dither}
+	e.jpeg.Progressive = o.Interlace
+	e.jpeg.Subsampling = chromaSubsampling[o.Chroma]
+	if (o.Metadata == "icc" || o.Metadata == "keep") && sourceFormat == "jpeg" {
+		e.jpeg.Segments = jpegenc.Metadata(source, true, o.Metadata == "keep")
+	}
+	return e
+}
+
+// lossyFormat reports whether the quality option applies to a format.
+// WebP and AVIF are currently JPEG encoded.
+func lossyFormat(format string) bool {
+	switch format {
+	case "jpeg", "webp", "avif":
+		return true
+	}
+	return false
+}
+
+// palettedFormat reports whether a format is limited to a palette.
+func palettedFormat(format string) bool {
+	return format == "png8" || format == "gif"
+}
+
+// encode encodes an image in the requested format and returns it
+// together with its Content-Type.
+func (e encoder) encode(img image.Image, quality int) ([]byte, string, error) {
+	// Note: Due to limitations in Go's standard library, all formats are currently encoded as JPEG internally
+	// but served with the appropriate Content-Type header to simulate format conversion
+	var buf bytes.Buffer
+	var contentType string
+	var err error
+	jpegOptions := e.jpeg
+	jpegOptions.Quality = quality
+	switch e.format {
+	case "jpg", "jpeg":
+		err = jpegenc.Encode(&buf, img, &jpegOptions)
+		contentType = "image/jpeg"
+	case "png":
+		err = png.Encode(&buf, img)
+		contentType = "image/png"
+	case "png8":
+		err = png.Encode(&buf, quantize.Paletted(img, e.colors, e.dither))
+		contentType = "image/png"
+	case "gif":
+		err = gif.Encode(&buf, quantize.Paletted(img, e.colors, e.dither), nil)
+		contentType = "image/gif"
+	case "bmp":
+		err = bmp.Encode(&buf, img)
+		contentType = "image/bmp"
+	case "tiff":
+		err = tiff.Encode(&buf, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+		contentType = "image/tiff"
+	case "webp":
+		// For webp, we need to handle this separately as Go stdlib doesn't encode webp
+		// For now, we'll return as WebP since that's what was requested (even though we encode as JPEG internally)
+		err = jpegenc.Encode(&buf, img, &jpegOptions)
+		contentType = "image/webp"
+	case "avif":
+		// For avif, return as AVIF since that's what was requested (even though we encode as JPEG internally)
+		err = jpegenc.Encode(&buf, img, &jpegOptions)
+		contentType = "image/avif"
+	default:
+		// Default to WebP
+		err = jpegenc.Encode(&buf, img, &jpegOptions)
+		contentType = "image/webp"
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("Error encoding image: %v", err)
+	}
+	return buf.Bytes(), contentType, nil
+}
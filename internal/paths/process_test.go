@@ -0,0 +1,64 @@
+package paths
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/javadalmasi/Thumbs/internal/jpegscale"
+)
+
+// benchmarkJPEG returns a 1280x720 quality 85 JPEG, the size of a
+// maxresdefault thumbnail, with gradients and noise so it compresses
+// roughly like a photo.
+func benchmarkJPEG(b *testing.B) []byte {
+	r := rand.New(rand.NewSource(1))
+	m := image.NewRGBA(image.Rect(0, 0, 1280, 720))
+	for y := 0; y < 720; y++ {
+		for x := 0; x < 1280; x++ {
+			n := r.Intn(32)
+			m.Set(x, y, color.RGBA{uint8(x/6 + n), uint8(y/3 + n), uint8((x+y)/8 + n), 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, &jpeg.Options{Quality: 85}); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkShrinkOnLoad compares a full decode followed by the resize with
+// the reduced DCT scale decode that processImage uses.
+func BenchmarkShrinkOnLoad(b *testing.B) {
+	data := benchmarkJPEG(b)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []image.Point{{320, 180}, {160, 90}, {80, 45}} {
+		b.Run(fmt.Sprintf("%dx%d/full", size.X, size.Y), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				img, err := jpeg.Decode(bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+				imaging.Resize(img, size.X, size.Y, imaging.Lanczos)
+			}
+		})
+		scale := shrinkOnLoadScale("jpeg", cfg, size.X, size.Y)
+		b.Run(fmt.Sprintf("%dx%d/scaled_1_%d", size.X, size.Y, scale), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				img, err := jpegscale.DecodeScaled(bytes.NewReader(data), scale)
+				if err != nil {
+					b.Fatal(err)
+				}
+				imaging.Resize(img, size.X, size.Y, imaging.Lanczos)
+			}
+		})
+	}
+}
@@ -1,16 +1,13 @@
 package paths
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"hash/crc64"
-	"image"
-	_ "image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
+	"math"
 	"math/big"
 	"math/rand"
 	"net/http"
@@ -18,9 +15,18 @@ import (
 	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
+	"github.com/javadalmasi/Thumbs/internal/availability"
+	"github.com/javadalmasi/Thumbs/internal/blocklist"
+	"github.com/javadalmasi/Thumbs/internal/cache"
+	"github.com/javadalmasi/Thumbs/internal/cdn"
 	"github.com/javadalmasi/Thumbs/internal/config"
 	"github.com/javadalmasi/Thumbs/internal/httpc"
+	"github.com/javadalmasi/Thumbs/internal/jpegenc"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+	"github.com/javadalmasi/Thumbs/internal/ratelimit"
+	"github.com/javadalmasi/Thumbs/internal/upgrade"
+	"github.com/javadalmasi/Thumbs/internal/utils"
+	"github.com/javadalmasi/Thumbs/internal/workers"
 )
 
 var Version = "build"
@@ -58,358 +64,385 @@ func generateRequestID() string {
 	return string(b)
 }
 
-func Vi(w http.ResponseWriter, req *http.Request) {
-	
+
+// resolveVideoId extracts and decodes the encoded video ID from the path.
+// On failure it writes the error response and returns false.
+func resolveVideoId(w http.ResponseWriter, req *http.Request) (decodedID, bool) {
+	route := routeOf(req)
+
 	// Extract encoded video ID from path
 	path := req.URL.EscapedPath()
-	encodedVideoId := strings.TrimPrefix(path, "/vi/")
+	encodedVideoId := strings.TrimPrefix(path, route.prefix)
 	encodedVideoId = strings.Split(encodedVideoId, "/")[0] // Get just the ID part
 
-	// Only accept 12-character encoded IDs
-	var videoId string
-	if len(encodedVideoId) == 12 {
-		// Decode the 12-character encoded ID to get the 11-character YouTube ID
-		secret := config.Cfg.Companion.Secret_key
-		if secret == "" {
+	// Raw 11-character IDs are used as they are where the policy allows them
+	if len(encodedVideoId) == expectedInputLen {
+		if !route.allowsRaw() {
 			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, "Secret key not configured")
-			return
+			io.WriteString(w, "Raw video IDs are not allowed on this route")
+			return decodedID{}, false
 		}
-		
-		decodedId, err := Decode(encodedVideoId, secret)
-		if err != nil {
+		if err := validateID(encodedVideoId, expectedInputLen); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, fmt.Sprintf("Invalid encoded ID: %v", err))
-			return
+			io.WriteString(w, fmt.Sprintf("Invalid video ID: %v", err))
+			return decodedID{}, false
 		}
-		videoId = decodedId
-	} else {
+		return checkBlocked(w, req, decodedID{VideoId: encodedVideoId})
+	}
+	if !route.allowsEncoded() {
 		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, fmt.Sprintf("Invalid ID length: got %d, expected 12 for encoded ID", len(encodedVideoId)))
-		return
+		io.WriteString(w, fmt.Sprintf("Invalid ID length: got %d, expected %d for a raw video ID", len(encodedVideoId), expectedInputLen))
+		return decodedID{}, false
 	}
 
-	// Parse Alibaba-style image processing parameters
-	query := req.URL.Query()
-	
-	// Extract resize parameters from both direct params and x-oss-process format
-	var resizeWidth, resizeHeight int
-	var quality int = 85 // Default quality
-	var format string = "webp" // Default format
-	
-	// Check for x-oss-process parameter (Alibaba format)
-	if ossProcess := query.Get("x-oss-process"); ossProcess != "" {
-		// Parse Alibaba-style parameters: x-oss-process=image/resize,w_320,h_160/format,jpg/quality,q_90
-		if strings.HasPrefix(ossProcess, "image/") {
-			operations := strings.Split(ossProcess[6:], "/") // Remove "image/" prefix
-			for _, op := range operations {
-				if strings.HasPrefix(op, "resize,") {
-					// Parse resize parameters: resize,w_320,h_160
-					params := strings.Split(op[7:], ",") // Remove "resize," prefix
-					for _, param := range params {
-						if strings.HasPrefix(param, "w_") {
-							if w, err := strconv.Atoi(param[2:]); err == nil && w > 0 {
-								resizeWidth = w
-							}
-						} else if strings.HasPrefix(param, "h_") {
-							if h, err := strconv.Atoi(param[2:]); err == nil && h > 0 {
-								resizeHeight = h
-							}
-						}
-					}
-				} else if strings.HasPrefix(op, "format,") {
-					// Parse format parameter: format,jpg
-					formatParam := op[7:] // Remove "format," prefix
-					switch strings.ToLower(formatParam) {
-					case "jpg", "jpeg":
-						format = "jpeg"
-					case "png":
-						format = "png"
-					case "webp":
-						format = "webp"
-					case "avif":
-						format = "avif"
-					}
-				} else if strings.HasPrefix(op, "quality,") {
-					// Parse quality parameter: quality,q_90
-					qualityParam := op[8:] // Remove "quality," prefix
-					if strings.HasPrefix(qualityParam, "q_") {
-						if q, err := strconv.Atoi(qualityParam[2:]); err == nil && q >= 1 && q <= 100 {
-							quality = q
-						}
-					} else {
-						// Support numeric quality directly
-						if q, err := strconv.Atoi(qualityParam); err == nil && q >= 1 && q <= 100 {
-							quality = q
-						}
-					}
-				}
-			}
-		}
+	// Only accept 16 and 22-character (v2) and 12-character (v1) encoded IDs
+	switch len(encodedVideoId) {
+	case expectedV2Len, expiringV2Len, expectedOutputLen:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf("Invalid ID length: got %d, expected %d, %d or %d for encoded ID", len(encodedVideoId), expectedV2Len, expiringV2Len, expectedOutputLen))
+		return decodedID{}, false
 	}
-	
-	// Check for direct parameters (fallback/alternative)
-	if resizeWidth == 0 && resizeHeight == 0 {
-		if widthStr := query.Get("width"); widthStr != "" {
-			if width, err := strconv.Atoi(widthStr); err == nil && width > 0 {
-				resizeWidth = width
-			}
-		}
-		
-		if heightStr := query.Get("height"); heightStr != "" {
-			if height, err := strconv.Atoi(heightStr); err == nil && height > 0 {
-				resizeHeight = height
-			}
-		}
+
+	// Decode the encoded ID to get the 11-character YouTube ID
+	if len(config.Cfg.Companion.Keys) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Secret key not configured")
+		return decodedID{}, false
 	}
-	
-	if quality == 85 {
-		if qualityStr := query.Get("quality"); qualityStr != "" {
-			if q, err := strconv.Atoi(qualityStr); err == nil && q >= 1 && q <= 100 {
-				quality = q
-			}
-		} else if qStr := query.Get("q"); qStr != "" {
-			// Support Alibaba-style quality parameter
-			if q, err := strconv.Atoi(qStr); err == nil && q >= 1 && q <= 100 {
-				quality = q
-			}
-		}
+
+	d, err := decodeID(encodedVideoId)
+	if errors.Is(err, errExpired) {
+		writeOSSError(w, req, http.StatusForbidden, "AccessDenied", "Request has expired.")
+		return decodedID{}, false
 	}
-	
-	if format == "webp" {
-		if formatStr := query.Get("format"); formatStr != "" {
-			switch strings.ToLower(formatStr) {
-			case "jpg", "jpeg":
-				format = "jpeg"
-			case "png":
-				format = "png"
-			case "webp":
-				format = "webp"
-			case "avif":
-				format = "avif"
-			}
-		}
+	// Forged IDs and disabled versions look like videos that do not exist
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, fmt.Sprintf("Invalid encoded ID: %v", err))
+		return decodedID{}, false
 	}
-	
-	// No processing needed - just fetch the original image
+	return checkBlocked(w, req, d)
+}
+
+// checkBlocked rejects videos on the blocklist (or missing from the
+// allowlist) with 451.
+func checkBlocked(w http.ResponseWriter, req *http.Request, d decodedID) (decodedID, bool) {
+	if blocklist.Blocked(d.VideoId) {
+		metrics.Inc("blocklist_rejected")
+		writeOSSError(w, req, http.StatusUnavailableForLegalReasons, "AccessDenied", "The requested video is unavailable for legal reasons.")
+		return decodedID{}, false
+	}
+	return d, true
+}
+
+// fetchBest tries the quality levels in order of priority (highest first)
+// and returns the first successful response together with its rendition.
+// The response is nil if no rendition could be fetched.
+func fetchBest(method, videoId string) (*http.Response, string) {
 	qualityLevels := []string{
-		"maxresdefault.jpg",  // Highest quality
-		"hqdefault.jpg",     // High quality 
+		"maxresdefault.jpg", // Highest quality
+		"hqdefault.jpg",     // High quality
 		"mqdefault.jpg",     // Medium quality
 		"sddefault.jpg",     // Standard definition
 		"default.jpg",       // Lowest quality
 	}
 
-	// Try quality levels in order of priority (highest first)
-	// Stop at the first successful response
-	var resp *http.Response
-	var host string
-	
 	for _, qualityLevel := range qualityLevels {
+		// Skip renditions we already know do not exist for this video
+		if availability.Missing(videoId, qualityLevel) {
+			continue
+		}
+
 		// Randomly select between hosts to reduce blocking
 		hosts := []string{"i.ytimg.com", "img.youtube.com"}
-		host = hosts[rand.Intn(len(hosts))]
-		
+		host := hosts[rand.Intn(len(hosts))]
+
 		// Construct the URL for this quality level
 		imageURL := fmt.Sprintf("https://%s/vi/%s/%s", host, videoId, qualityLevel)
-		
+
 		// Create and send the request
-		request, err := http.NewRequest(req.Method, imageURL, nil)
+		request, err := http.NewRequest(method, imageURL, nil)
 		if err != nil {
 			continue
 		}
-		
+
 		request.Header.Set("User-Agent", default_ua)
 		request.Header.Set("Accept", "image/webp,image/apng,image/*,*/*;q=0.8")
 		request.Header.Set("Accept-Encoding", "gzip, deflate")
-		
-		resp, err = httpc.Client.Do(request)
+
+		resp, err := httpc.Client.Do(request)
 		if err != nil {
 			continue
 		}
-		
-		// Check if this is a successful response
+
+		// Stop at the first successful response
 		if resp.StatusCode == 200 {
-			// Success! We found the highest available quality
-			break
-		} else {
-			// Close the response body and try the next quality level
-			resp.Body.Close()
-			resp = nil
+			availability.Set(videoId, qualityLevel, true)
+			return resp, qualityLevel
+		}
+
+		// Close the response body and try the next quality level
+		if resp.StatusCode == 404 {
+			availability.Set(videoId, qualityLevel, false)
 		}
+		resp.Body.Close()
 	}
-	
-	// Check if we found any successful response
+	return nil, ""
+}
+
+// writeImage sends a thumbnail with Alibaba-style response headers. For
+// expiring IDs, caches may only keep the response until the ID expires.
+func writeImage(w http.ResponseWriter, e *cache.Entry, opts imageOptions, cacheStatus string, expires time.Time) {
+	for key, values := range e.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	// Add Alibaba-style response headers
+	maxAge := 31536000 // 1 year
+	if expires.IsZero() {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", maxAge))
+		expires = time.Now().AddDate(1, 0, 0)
+	} else {
+		maxAge = max(int(time.Until(expires).Seconds()), 0)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	}
+	if config.Cfg.Enable_litespeed_cache {
+		w.Header().Set("X-LiteSpeed-Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+	if config.Cfg.Cdn.Enable_tags {
+		var extra []string
+		if opts.Watermark.Image != "" {
+			extra = append(extra, cdn.WatermarkTag(opts.Watermark.Image))
+		}
+		cdn.SetHeaders(w.Header(), e.VideoId, e.Rendition, e.Transform, extra...)
+	}
+	w.Header().Set("Expires", expires.Format(http.TimeFormat))
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("X-OSS-Hash-Crc64ecma", fmt.Sprintf("%d", hashString(e.VideoId))) // Generate hash based on video ID
+	w.Header().Set("X-OSS-Object-Type", "Normal")
+	w.Header().Set("X-OSS-Request-Id", generateRequestID())
+	if e.Processed {
+		w.Header().Set("X-OSS-Server-Time", "3")
+	} else {
+		w.Header().Set("X-OSS-Server-Time", "2")
+	}
+	w.Header().Set("X-OSS-Storage-Class", "Standard")
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", generateRequestID()[:16]))
+	if cache.Enabled() {
+		w.Header().Set("X-Thumbs-Cache", cacheStatus)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.Body)
+}
+
+// requestError is an error that is reported to the client with a status
+// code. Errors with a Code are sent as OSS-style XML errors.
+type requestError struct {
+	Status     int
+	Message    string
+	Code       string
+	RetryAfter time.Duration
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+func (e *requestError) write(w http.ResponseWriter, req *http.Request) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	if e.Code != "" {
+		writeOSSError(w, req, e.Status, e.Code, e.Message)
+		return
+	}
+	w.WriteHeader(e.Status)
+	io.WriteString(w, e.Message)
+}
+
+// loadImage fetches the best available rendition of a video from YouTube
+// and applies the requested options to it.
+func loadImage(method, videoId string, opts imageOptions) (*cache.Entry, *requestError) {
+	resp, rendition := fetchBest(method, videoId)
 	if resp == nil {
 		// No successful response found
-		w.WriteHeader(http.StatusNotFound)
-		io.WriteString(w, "No image found for this video")
-		return
+		return nil, &requestError{Status: http.StatusNotFound, Message: "No image found for this video"}
 	}
-	
-	// Check if image processing is needed
-	needProcessing := resizeWidth > 0 || resizeHeight > 0 || format != "webp" || quality != 85
-	
-	if needProcessing {
-		// Process the image
-		imageData, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, "Error reading image data")
-			return
+	defer resp.Body.Close()
+
+	// Remember videos served from a fallback rendition so the upgrade
+	// worker can re-probe maxresdefault for them later
+	upgrade.Track(videoId, rendition)
+
+	imageData, rerr := readBody(resp)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	e := &cache.Entry{
+		VideoId:   videoId,
+		Transform: opts.canonical(),
+		Rendition: rendition,
+		Header:    http.Header{},
+	}
+	if opts.changesImage() {
+		var result processedImage
+		var err error
+		perr := workers.Run(opts.small(), func() {
+			result, err = processImage(imageData, opts)
+		})
+		if perr != nil {
+			return nil, &requestError{
+				Status:     http.StatusServiceUnavailable,
+				Code:       "ServiceUnavailable",
+				Message:    "Too many images are being processed, please retry later.",
+				RetryAfter: workers.RetryAfter(),
+			}
+		}
+		if errors.As(err, &rerr) {
+			return nil, rerr
 		}
-		
-		// Decode the image
-		img, _, err := image.Decode(bytes.NewReader(imageData))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, fmt.Sprintf("Error decoding image: %v", err))
+			return nil, &requestError{Status: http.StatusInternalServerError, Message: err.Error()}
+		}
+		e.Body = result.Body
+		e.Processed = true
+		e.Header.Set("Content-Type", result.ContentType)
+		e.Header.Set("Content-Length", strconv.Itoa(len(result.Body)))
+		if opts.MaxBytes > 0 {
+			// Report what fitting the byte budget settled on
+			e.Header.Set("X-Thumbs-Quality", strconv.Itoa(result.Quality))
+			e.Header.Set("X-Thumbs-Bytes", strconv.Itoa(len(result.Body)))
+			e.Header.Set("X-Thumbs-Dimensions", fmt.Sprintf("%dx%d", result.Width, result.Height))
+		}
+	} else {
+		// No processing needed, forward the original image
+		e.Body = imageData
+		if opts.Metadata == "strip" {
+			// Drop the metadata segments without decoding the image
+			e.Body = jpegenc.StripMetadata(imageData)
+		}
+		utils.CopyHeadersNew(resp.Header, e.Header)
+		if method == "GET" {
+			e.Header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+		}
+	}
+	return e, nil
+}
+
+// serveImage serves a thumbnail from the local cache, the peer owning the
+// video or YouTube, in that order. rawQuery holds the processing
+// parameters forwarded to the peer.
+func serveImage(w http.ResponseWriter, req *http.Request, id decodedID, opts imageOptions, rawQuery string) {
+	// Requested sizes above the output limits fail before any upstream work
+	if rerr := checkOutput(opts.Width, opts.Height); rerr != nil {
+		rerr.write(w, req)
+		return
+	}
+
+	transform := opts.canonical()
+
+	if e := cache.Get(id.VideoId, transform); e != nil {
+		if retry := ratelimit.AllowHit(req); retry > 0 {
+			writeThrottled(w, req, retry)
 			return
 		}
-		
-		// Handle resize - if only one dimension is specified, calculate the other to maintain aspect ratio
-		var finalWidth, finalHeight int
-		imgBounds := img.Bounds()
-		origWidth := imgBounds.Dx()
-		origHeight := imgBounds.Dy()
-		
-		if resizeWidth > 0 && resizeHeight > 0 {
-			// Both dimensions specified - resize to exact dimensions
-			finalWidth = resizeWidth
-			finalHeight = resizeHeight
-		} else if resizeWidth > 0 {
-			// Only width specified - calculate height to maintain aspect ratio
-			finalWidth = resizeWidth
-			finalHeight = int(float64(origHeight) * float64(resizeWidth) / float64(origWidth))
-		} else if resizeHeight > 0 {
-			// Only height specified - calculate width to maintain aspect ratio
-			finalHeight = resizeHeight
-			finalWidth = int(float64(origWidth) * float64(resizeHeight) / float64(origHeight))
-		} else {
-			// Neither specified - use original dimensions
-			finalWidth = origWidth
-			finalHeight = origHeight
+		writeImage(w, e, opts, "HIT", id.Expires)
+		return
+	}
+
+	if retry := ratelimit.AllowMiss(req, opts.changesImage()); retry > 0 {
+		writeThrottled(w, req, retry)
+		return
+	}
+
+	if req.Method == "GET" {
+		if e := fetchFromPeer(id.VideoId, transform, rawQuery); e != nil {
+			writeImage(w, e, opts, "PEER", id.Expires)
+			return
 		}
-		
-		// Resize the image
-		resizedImg := imaging.Resize(img, finalWidth, finalHeight, imaging.Lanczos)
-		
-		// Encode the resized image based on requested format
-		// Note: Due to limitations in Go's standard library, all formats are currently encoded as JPEG internally
-		// but served with the appropriate Content-Type header to simulate format conversion
-		var buf bytes.Buffer
-		switch format {
-		case "jpg", "jpeg":
-			err = jpeg.Encode(&buf, resizedImg, &jpeg.Options{Quality: quality})
-			w.Header().Set("Content-Type", "image/jpeg")
-		case "png":
-			err = png.Encode(&buf, resizedImg)
-			w.Header().Set("Content-Type", "image/png")
-		case "webp":
-			// For webp, we need to handle this separately as Go stdlib doesn't encode webp
-			// For now, we'll return as WebP since that's what was requested (even though we encode as JPEG internally)
-			err = jpeg.Encode(&buf, resizedImg, &jpeg.Options{Quality: quality})
-			w.Header().Set("Content-Type", "image/webp")
-		case "avif":
-			// For avif, return as AVIF since that's what was requested (even though we encode as JPEG internally)
-			err = jpeg.Encode(&buf, resizedImg, &jpeg.Options{Quality: quality})
-			w.Header().Set("Content-Type", "image/avif")
-		default:
-			// Default to WebP
-			err = jpeg.Encode(&buf, resizedImg, &jpeg.Options{Quality: quality})
-			w.Header().Set("Content-Type", "image/webp")
+	}
+
+	e, rerr := loadImage(req.Method, id.VideoId, opts)
+	if rerr != nil {
+		rerr.write(w, req)
+		return
+	}
+
+	// HEAD responses have no body worth caching
+	if req.Method == "GET" {
+		cache.Set(e)
+	}
+	writeImage(w, e, opts, "MISS", id.Expires)
+}
+
+func Vi(w http.ResponseWriter, req *http.Request) {
+	advertiseClientHints(w)
+
+	id, ok := resolveVideoId(w, req)
+	if !ok {
+		return
+	}
+
+	// /vi/{id}/e/{blob} carries its processing parameters encrypted, and
+	// the visible query is ignored
+	if blob, ok := instructionBlob(req); ok {
+		query, blobExpires, err := decryptInstructions(id.VideoId, blob)
+		if errors.Is(err, errExpired) {
+			writeOSSError(w, req, http.StatusForbidden, "AccessDenied", "Request has expired.")
+			return
 		}
-		
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, fmt.Sprintf("Error encoding image: %v", err))
+			writeOSSError(w, req, http.StatusForbidden, "AccessDenied", "The instruction blob could not be decrypted.")
 			return
 		}
-		
-		// Add Alibaba-style response headers
-		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // 1 year
-		w.Header().Set("X-OSS-Hash-Crc64ecma", fmt.Sprintf("%d", hashString(videoId))) // Generate hash based on video ID
-		w.Header().Set("X-OSS-Object-Type", "Normal")
-		w.Header().Set("X-OSS-Request-Id", generateRequestID())
-		w.Header().Set("X-OSS-Server-Time", "3")
-		w.Header().Set("X-OSS-Storage-Class", "Standard")
-		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", generateRequestID()[:16]))
-		
-		// Set CORS headers (Alibaba OSS style)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		
-		// Send the processed image
-		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
-		w.WriteHeader(http.StatusOK)
-		w.Write(buf.Bytes())
-	} else {
-		// No processing needed, forward original image with Alibaba-style headers
-		defer resp.Body.Close()
-		
-		// Add Alibaba-style response headers
-		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // 1 year
-		w.Header().Set("X-OSS-Hash-Crc64ecma", fmt.Sprintf("%d", hashString(videoId))) // Generate hash based on video ID
-		w.Header().Set("X-OSS-Object-Type", "Normal")
-		w.Header().Set("X-OSS-Request-Id", generateRequestID())
-		w.Header().Set("X-OSS-Server-Time", "2")
-		w.Header().Set("X-OSS-Storage-Class", "Standard")
-		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", generateRequestID()[:16]))
-		
-		// Set CORS headers (Alibaba OSS style)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		
-		// Copy only necessary headers from original response, removing YouTube-specific ones
-		for key, values := range resp.Header {
-			lowerKey := strings.ToLower(key)
-			// Skip YouTube-specific headers
-			if !strings.Contains(lowerKey, "youtube") && 
-			   !strings.Contains(lowerKey, "x-youtube") &&
-			   !strings.Contains(lowerKey, "server") {
-				for _, value := range values {
-					w.Header().Add(key, value)
-				}
-			}
+		if !blobExpires.IsZero() && (id.Expires.IsZero() || blobExpires.Before(id.Expires)) {
+			id.Expires = blobExpires
 		}
-		
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		opts := parseOptions(query)
+		applyClientHints(w, req.Header, &opts)
+		serveImage(w, req, id, opts, forwardedQuery(opts, query.Encode()))
+		return
 	}
-	
-	// We got a response, forward it to the client
-	defer resp.Body.Close()
-	
-	// Add standard headers
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // 1 year
-	if config.Cfg.Enable_litespeed_cache {
-		w.Header().Set("X-LiteSpeed-Cache-Control", "max-age=31536000") // 1 year for LiteSpeed
+
+	// Parse Alibaba-style image processing parameters
+	opts := parseOptions(req.URL.Query())
+	applyClientHints(w, req.Header, &opts)
+
+	signatureExpires, err := verifySignature(req, opts)
+	switch {
+	case errors.Is(err, errExpired):
+		writeOSSError(w, req, http.StatusForbidden, "AccessDenied", "Request has expired.")
+		return
+	case errors.Is(err, errMissingSignature):
+		writeOSSError(w, req, http.StatusForbidden, "AccessDenied", "Request signature is required for image processing.")
+		return
+	case err != nil:
+		writeOSSError(w, req, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
 	}
-	w.Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-	w.Header().Set("Vary", "Accept")
-	
-	
-	// Set CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-	w.Header().Set("Access-Control-Max-Age", "1728000")
-	
-	// Copy headers from original response
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	// Caches may not keep a signed response past the signature's expiry
+	if !signatureExpires.IsZero() && (id.Expires.IsZero() || signatureExpires.Before(id.Expires)) {
+		id.Expires = signatureExpires
 	}
-	
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}// validateID checks if the ID contains only valid base64-url characters
+
+	serveImage(w, req, id, opts, forwardedQuery(opts, req.URL.RawQuery))
+}
+
+// forwardedQuery returns the query a peer needs to produce the same variant.
+// Peers do not see the Client Hints, so resolved options replace auto.
+func forwardedQuery(opts imageOptions, rawQuery string) string {
+	if opts.AutoWidth || opts.AutoDPR {
+		return opts.query()
+	}
+	return rawQuery
+}
+
+// validateID checks if the ID contains only valid base64-url characters
 func validateID(id string, expectedLen int) error {
 	if len(id) != expectedLen {
 		return fmt.Errorf("invalid length: expected %d, got %d", expectedLen, len(id))
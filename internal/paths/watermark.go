@@ -0,0 +1,143 @@
+package paths
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/javadalmasi/Thumbs/internal/cdn"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+	"github.com/javadalmasi/Thumbs/internal/watermark"
+)
+
+// parseWatermark reads the parameters of the OSS watermark operation,
+// e.g. text_SGVsbG8,size_30,g_se,x_10,y_10, which the watermark direct
+// parameter takes as well. Text, font and image names are base64url
+// encoded. Invalid values are ignored like those of other operations, and
+// a watermark without valid text or image is dropped.
+func parseWatermark(spec string) watermark.Options {
+	o := watermark.Options{
+		Font:    watermark.DefaultFont,
+		Color:   color.NRGBA{A: 0xff},
+		Size:    watermark.DefaultSize,
+		Opacity: watermark.DefaultOpacity,
+		Gravity: watermark.DefaultGravity,
+		X:       watermark.DefaultMargin,
+		Y:       watermark.DefaultMargin,
+	}
+	for _, param := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(param, "_")
+		switch key {
+		case "text":
+			if t, ok := watermark.Decode(value); ok && t != "" && utf8.ValidString(t) && utf8.RuneCountInString(t) <= watermark.MaxTextLength {
+				o.Text = t
+			}
+		case "type":
+			if f, ok := watermark.Decode(value); ok && watermark.HasFont(f) {
+				o.Font = f
+			}
+		case "color":
+			if c, err := hex.DecodeString(value); err == nil && len(c) == 3 {
+				o.Color = color.NRGBA{R: c[0], G: c[1], B: c[2], A: 0xff}
+			}
+		case "size":
+			if v, err := strconv.Atoi(value); err == nil && v > 0 && v <= watermark.MaxSize {
+				o.Size = v
+			}
+		case "image":
+			if name, ok := watermark.Decode(value); ok && watermark.ValidImage(name) {
+				o.Image = name
+			}
+		case "P":
+			if v, err := strconv.Atoi(value); err == nil && v >= 1 && v <= 100 {
+				o.Percent = v
+			}
+		case "t":
+			if v, err := strconv.Atoi(value); err == nil && v >= 0 && v <= 100 {
+				o.Opacity = v
+			}
+		case "g":
+			if g := strings.ToLower(value); watermark.ValidGravity(g) {
+				o.Gravity = g
+			}
+		case "x":
+			if v, err := strconv.Atoi(value); err == nil && v >= 0 && v <= watermark.MaxMargin {
+				o.X = v
+			}
+		case "y":
+			if v, err := strconv.Atoi(value); err == nil && v >= 0 && v <= watermark.MaxMargin {
+				o.Y = v
+			}
+		case "fill":
+			o.Tile = value == "1"
+		}
+	}
+	if o.Empty() {
+		return watermark.Options{}
+	}
+	// Settings of an absent part do not split the cache
+	if o.Text == "" {
+		o.Font, o.Color, o.Size = "", color.NRGBA{}, 0
+	}
+	if o.Image == "" {
+		o.Percent = 0
+	}
+	if o.Tile {
+		o.Gravity = ""
+	}
+	return o
+}
+
+// watermarkKey returns a short cache key part for a watermark, whose text
+// can be long. It includes the content of the image, so replacing a file
+// in WATERMARK_DIR gives its variants new keys.
+func watermarkKey(o watermark.Options) string {
+	spec := o.String()
+	if o.Image != "" {
+		spec += ",v_" + watermark.ImageVersion(o.Image)
+	}
+	sum := sha256.Sum256([]byte(spec))
+	return hex.EncodeToString(sum[:8])
+}
+
+// PurgeWatermark asks the configured CDNs to drop every response that
+// carries a watermark image. The local caches need no purge, since the
+// new image changes the cache keys.
+func PurgeWatermark(name string) {
+	cdn.NotifyWatermark(name)
+}
+
+// applyWatermark draws the watermark of a request, if any.
+func applyWatermark(img image.Image, o watermark.Options) (image.Image, error) {
+	if o.Empty() {
+		return img, nil
+	}
+	metrics.Inc("watermarks")
+	img, err := watermark.Apply(img, o)
+	if errors.Is(err, watermark.ErrImageNotFound) {
+		return nil, &requestError{
+			Status:  http.StatusBadRequest,
+			Code:    "WatermarkImageNotFound",
+			Message: fmt.Sprintf("The watermark image %q does not exist.", o.Image),
+		}
+	}
+	if errors.Is(err, watermark.ErrTooLarge) {
+		metrics.Inc("limit_output_pixels")
+		return nil, &requestError{
+			Status:  http.StatusBadRequest,
+			Code:    "WatermarkTooLarge",
+			Message: "The watermark text exceeds the maximum output size.",
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error applying watermark: %v", err)
+	}
+	return img, nil
+}
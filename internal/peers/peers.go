@@ -0,0 +1,276 @@
+// Package peers lets a cluster of Thumbs instances share their caches,
+// similar to groupcache. Every cache key, a video plus its transform, is
+// owned by one instance picked with consistent hashing; other instances
+// fetch it from the owner over HTTP before going to YouTube, and keep a
+// local replica of hot keys.
+package peers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/cache"
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// TokenHeader carries the shared secret on requests between peers.
+const TokenHeader = "X-Thumbs-Peer-Token"
+
+var client = &http.Client{
+	Timeout: 5 * time.Second,
+}
+
+// downBackoff is how long a peer that could not be reached is skipped,
+// so a dead owner does not cost every request the client timeout.
+const downBackoff = 10 * time.Second
+
+var mu sync.RWMutex
+var ring *Ring
+var self string
+var members []string
+
+var hotMu sync.Mutex
+var hot = map[string]int{}
+
+var downMu sync.Mutex
+var downUntil = map[string]time.Time{}
+
+// Start builds the ring from the static peer list or, if configured, from
+// a DNS SRV record that is looked up again every refresh interval.
+func Start() {
+	c := config.Cfg.Peers
+	self = strings.TrimSuffix(c.Self, "/")
+
+	if c.Srv != "" {
+		refreshSRV(c.Srv)
+		go func() {
+			for {
+				time.Sleep(time.Duration(c.Refresh) * time.Second)
+				refreshSRV(c.Srv)
+			}
+		}()
+	} else {
+		var list []string
+		for _, peer := range strings.Split(c.List, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				list = append(list, peer)
+			}
+		}
+		setPeers(list)
+	}
+
+	// Hot key counters are per minute
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+			hotMu.Lock()
+			hot = map[string]int{}
+			hotMu.Unlock()
+		}
+	}()
+
+	metrics.Gauge("peers", func() any {
+		mu.RLock()
+		defer mu.RUnlock()
+		return len(members)
+	})
+}
+
+func setPeers(list []string) {
+	seen := map[string]bool{}
+	var peers []string
+	for _, peer := range append(list, self) {
+		peer = strings.TrimSuffix(peer, "/")
+		if peer == "" || seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		peers = append(peers, peer)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(peers, ",") == strings.Join(members, ",") {
+		return
+	}
+	members = peers
+	ring = NewRing(config.Cfg.Peers.Vnodes, peers)
+	log.Printf("[INFO] [peers] Using peers: %s\n", strings.Join(peers, ", "))
+}
+
+func refreshSRV(name string) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		log.Printf("[ERROR] [peers] Failed to look up SRV record '%s': %s\n", name, err)
+		return
+	}
+	var list []string
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		list = append(list, "http://"+net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	}
+	// Keep the order stable so the comparison in setPeers is meaningful
+	sort.Strings(list)
+	setPeers(list)
+}
+
+// Owner returns the peer owning a cache key and whether that peer is
+// another instance. It is never remote while peer mode is disabled, or
+// while the owner is marked down.
+func Owner(key string) (string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ring == nil {
+		return "", false
+	}
+	owner := ring.Owner(key)
+	return owner, owner != "" && owner != self && !isDown(owner)
+}
+
+// markDown skips a peer for downBackoff after a failed request.
+func markDown(peer string) {
+	downMu.Lock()
+	defer downMu.Unlock()
+	if time.Now().After(downUntil[peer]) {
+		log.Printf("[INFO] [peers] Skipping '%s' for %s\n", peer, downBackoff)
+	}
+	downUntil[peer] = time.Now().Add(downBackoff)
+}
+
+func isDown(peer string) bool {
+	downMu.Lock()
+	defer downMu.Unlock()
+	return time.Now().Before(downUntil[peer])
+}
+
+// Hot counts a request for a key fetched from a peer and reports whether
+// it crossed the threshold for keeping a local replica.
+func Hot(key string) bool {
+	threshold := config.Cfg.Peers.Hot_threshold
+	if threshold <= 0 {
+		return false
+	}
+	hotMu.Lock()
+	defer hotMu.Unlock()
+	hot[key]++
+	return hot[key] >= threshold
+}
+
+// Fetch asks the owning peer for a thumbnail. rawQuery holds the original
+// processing parameters so the owner produces the same variant. A peer
+// that cannot be reached is marked down, and bodies larger than
+// MAX_UPSTREAM_BODY are rejected.
+func Fetch(owner, videoId, transform, rawQuery string) (*cache.Entry, error) {
+	u := owner + "/_peer/vi/" + url.PathEscape(videoId)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set(TokenHeader, config.Cfg.Peers.Token)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		markDown(owner)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+
+	limit := config.Cfg.Limits.Max_body
+	var r io.Reader = resp.Body
+	if limit > 0 {
+		r = io.LimitReader(resp.Body, limit+1)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		markDown(owner)
+		return nil, err
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return nil, fmt.Errorf("peer response is larger than %d bytes", limit)
+	}
+
+	e := &cache.Entry{
+		VideoId:   videoId,
+		Transform: transform,
+		Rendition: resp.Header.Get("X-Thumbs-Rendition"),
+		Processed: resp.Header.Get("X-Thumbs-Processed") == "1",
+		Header:    http.Header{},
+		Body:      body,
+	}
+	for _, key := range []string{"Content-Type", "Last-Modified", "X-Thumbs-Quality", "X-Thumbs-Bytes", "X-Thumbs-Dimensions"} {
+		if v := resp.Header.Get(key); v != "" {
+			e.Header.Set(key, v)
+		}
+	}
+	e.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return e, nil
+}
+
+// WriteEntry sends a cache entry to a peer in the format Fetch expects.
+func WriteEntry(w http.ResponseWriter, e *cache.Entry) {
+	for key, values := range e.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Set("X-Thumbs-Rendition", e.Rendition)
+	if e.Processed {
+		w.Header().Set("X-Thumbs-Processed", "1")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.Body)
+}
+
+// BroadcastPurge tells every other peer to purge a video from its local
+// cache, since hot keys may be replicated anywhere.
+func BroadcastPurge(videoId string) {
+	broadcastPurge(url.Values{"video_id": {videoId}})
+}
+
+// BroadcastPurgeVariant tells every other peer to purge one variant of a
+// video, identified by its canonical transform.
+func BroadcastPurgeVariant(videoId, transform string) {
+	broadcastPurge(url.Values{"video_id": {videoId}, "transform": {transform}})
+}
+
+func broadcastPurge(query url.Values) {
+	mu.RLock()
+	peers := members
+	mu.RUnlock()
+
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		go func(peer string) {
+			u := peer + "/_peer/purge?" + query.Encode()
+			request, err := http.NewRequest("POST", u, nil)
+			if err != nil {
+				return
+			}
+			request.Header.Set(TokenHeader, config.Cfg.Peers.Token)
+			resp, err := client.Do(request)
+			if err != nil {
+				log.Printf("[ERROR] [peers] Failed to send purge to '%s': %s\n", peer, err)
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+}
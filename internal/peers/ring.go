@@ -0,0 +1,49 @@
+package peers
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring is a consistent hash ring. Every peer is placed on the ring
+// replicas times so keys spread evenly and only a small slice of keys
+// moves when a peer joins or leaves.
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+}
+
+func NewRing(replicas int, peers []string) *Ring {
+	if replicas < 1 {
+		replicas = 1
+	}
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the peer owning a key, or the empty string if the ring
+// has no peers.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
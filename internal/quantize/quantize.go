@@ -0,0 +1,122 @@
+// Package quantize reduces images to a small palette with median cut, for
+// paletted outputs such as PNG8 and GIF. It implements draw.Quantizer, so
+// it also plugs into image/gif.
+package quantize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// maxSamples bounds the pixels a palette is computed from. Larger images
+// are sampled on a regular grid, which is plenty for thumbnails.
+const maxSamples = 1 << 16
+
+// MedianCut is a draw.Quantizer that repeatedly splits the box of colors
+// with the widest channel range at its median, and uses the mean of every
+// box as a palette entry. Images with fewer distinct colors than requested
+// get a shorter palette. Alpha is ignored, the palette is opaque.
+type MedianCut struct{}
+
+type box []rgb
+
+type rgb [3]uint8
+
+// Quantize appends up to cap(p)-len(p) colors to p that represent m.
+func (MedianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	if n <= 0 {
+		return p
+	}
+
+	boxes := []box{samples(m)}
+	for len(boxes) < n {
+		i, channel := widest(boxes)
+		if i < 0 {
+			break
+		}
+		b := boxes[i]
+		sort.Slice(b, func(x, y int) bool { return b[x][channel] < b[y][channel] })
+		mid := len(b) / 2
+		boxes[i] = b[:mid]
+		boxes = append(boxes, b[mid:])
+	}
+
+	for _, b := range boxes {
+		if len(b) == 0 {
+			continue
+		}
+		var sum [3]int
+		for _, c := range b {
+			sum[0] += int(c[0])
+			sum[1] += int(c[1])
+			sum[2] += int(c[2])
+		}
+		half := len(b) / 2
+		p = append(p, color.RGBA{
+			R: uint8((sum[0] + half) / len(b)),
+			G: uint8((sum[1] + half) / len(b)),
+			B: uint8((sum[2] + half) / len(b)),
+			A: 0xff,
+		})
+	}
+	return p
+}
+
+// samples returns the colors of m, or of a regular grid of its pixels if
+// it has more than maxSamples.
+func samples(m image.Image) box {
+	bounds := m.Bounds()
+	step := 1
+	for (bounds.Dx()/step)*(bounds.Dy()/step) > maxSamples {
+		step++
+	}
+	s := make(box, 0, (bounds.Dx()/step+1)*(bounds.Dy()/step+1))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := m.At(x, y).RGBA()
+			s = append(s, rgb{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+		}
+	}
+	return s
+}
+
+// widest returns the box with the widest range in any channel, and that
+// channel. It returns -1 when every box holds a single color.
+func widest(boxes []box) (int, int) {
+	best, bestChannel, bestRange := -1, 0, 0
+	for i, b := range boxes {
+		if len(b) < 2 {
+			continue
+		}
+		lo, hi := b[0], b[0]
+		for _, c := range b[1:] {
+			for ch := 0; ch < 3; ch++ {
+				lo[ch] = min(lo[ch], c[ch])
+				hi[ch] = max(hi[ch], c[ch])
+			}
+		}
+		for ch := 0; ch < 3; ch++ {
+			if r := int(hi[ch]) - int(lo[ch]); r > bestRange {
+				best, bestChannel, bestRange = i, ch, r
+			}
+		}
+	}
+	return best, bestChannel
+}
+
+// Paletted reduces m to at most colors colors, with Floyd-Steinberg error
+// diffusion if dither is set.
+func Paletted(m image.Image, colors int, dither bool) *image.Paletted {
+	bounds := m.Bounds()
+	palette := MedianCut{}.Quantize(make(color.Palette, 0, colors), m)
+	p := image.NewPaletted(bounds, palette)
+	if dither {
+		draw.FloydSteinberg.Draw(p, bounds, m, bounds.Min)
+	} else {
+		draw.Draw(p, bounds, m, bounds.Min, draw.Src)
+	}
+	return p
+}
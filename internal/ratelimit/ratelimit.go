@@ -0,0 +1,204 @@
+// Package ratelimit limits the request rate of every client with token
+// buckets. Cache hits and cache misses have separate budgets, so cached
+// traffic stays cheap while requests that go to YouTube or have to be
+// processed are limited more tightly.
+package ratelimit
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets, one per client, that refill at rate
+// tokens per second up to burst.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+var hits *Limiter
+var misses *Limiter
+var trusted []*net.IPNet
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Start creates the hit and miss limiters and parses the trusted proxies.
+func Start() {
+	c := config.Cfg.Rate_limit
+	hits = NewLimiter(c.Hit_rate, c.Hit_burst)
+	misses = NewLimiter(c.Miss_rate, c.Miss_burst)
+	trusted = ParseCIDRs(c.Trusted_proxies)
+
+	// Full buckets are the same as no bucket, drop them to bound memory
+	go func() {
+		for {
+			time.Sleep(1 * time.Minute)
+			hits.prune()
+			misses.prune()
+		}
+	}()
+
+	metrics.Gauge("ratelimit_clients", func() any { return hits.Len() + misses.Len() })
+	log.Printf("[INFO] Rate limiting enabled: %.1f/s hits, %.1f/s misses per client\n", c.Hit_rate, c.Miss_rate)
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs. Plain IPs are taken
+// as a single address.
+func ParseCIDRs(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("[ERROR] [ratelimit] Ignoring invalid CIDR '%s': %s\n", s, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isTrusted(ip net.IP) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent a request. If the
+// connection comes from a trusted proxy, X-Forwarded-For is walked from
+// the right and the first untrusted address is the client. Connections
+// without an IP, like the Unix socket, are trusted as proxies.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && !isTrusted(ip) {
+		return ip.String()
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(hop) {
+			break
+		}
+	}
+	if ip == nil {
+		return host
+	}
+	return ip.String()
+}
+
+// Take removes weight tokens from the bucket of key. It returns zero if
+// there were enough tokens, or else how long until there will be. The
+// rate has to be positive and weight at most the burst, which
+// checkConfig ensures.
+func (l *Limiter) Take(key string, weight float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= weight {
+		b.tokens -= weight
+		return 0
+	}
+	return time.Duration((weight - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// AllowHit takes one token from the hit budget of the client. It returns
+// zero if the request may proceed, or else when to retry. It is always
+// zero while rate limiting is disabled.
+func AllowHit(req *http.Request) time.Duration {
+	if hits == nil {
+		return 0
+	}
+	retry := hits.Take(ClientIP(req), 1)
+	if retry > 0 {
+		metrics.Inc("ratelimit_rejected_hits")
+	}
+	return retry
+}
+
+// AllowMiss takes tokens from the miss budget of the client. Requests
+// that have to be processed cost RATE_LIMIT_PROCESS_WEIGHT tokens, passthrough
+// requests one.
+func AllowMiss(req *http.Request, processed bool) time.Duration {
+	if misses == nil {
+		return 0
+	}
+	weight := 1.0
+	if processed {
+		weight = config.Cfg.Rate_limit.Process_weight
+	}
+	retry := misses.Take(ClientIP(req), weight)
+	if retry > 0 {
+		metrics.Inc("ratelimit_rejected_misses")
+	}
+	return retry
+}
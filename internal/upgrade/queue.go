@@ -0,0 +1,171 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/utils"
+)
+
+// Entry is a video ID that was served from a lower rendition than
+// maxresdefault and is waiting to be re-probed.
+type Entry struct {
+	VideoId   string    `json:"video_id"`
+	Rendition string    `json:"rendition"`
+	Attempts  int       `json:"attempts"`
+	NextProbe time.Time `json:"next_probe"`
+	Added     time.Time `json:"added"`
+}
+
+// Queue is a small, bounded set of pending upgrades that is persisted as
+// JSON so that pending work survives restarts.
+type Queue struct {
+	mu      sync.Mutex
+	path    string
+	size    int
+	dirty   bool
+	entries map[string]*Entry
+}
+
+func NewQueue(path string, size int) *Queue {
+	return &Queue{
+		path:    path,
+		size:    size,
+		entries: make(map[string]*Entry),
+	}
+}
+
+// Load reads the queue from disk. A missing file is not an error.
+func (q *Queue) Load() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if len(q.entries) >= q.size {
+			break
+		}
+		q.entries[e.VideoId] = e
+	}
+	return nil
+}
+
+// Save writes the queue to disk if it changed since the last save.
+// The file is replaced atomically so a crash never leaves it truncated.
+func (q *Queue) Save() error {
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	entries := make([]*Entry, 0, len(q.entries))
+	for _, e := range q.entries {
+		c := *e
+		entries = append(entries, &c)
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(q.path, data)
+}
+
+// Add enqueues a video ID. It returns false if the ID was already queued
+// or the queue is full.
+func (q *Queue) Add(videoId, rendition string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e, ok := q.entries[videoId]; ok {
+		// Remember the best rendition we have actually served.
+		if e.Rendition != rendition {
+			e.Rendition = rendition
+			q.dirty = true
+		}
+		return false
+	}
+	if len(q.entries) >= q.size {
+		return false
+	}
+	now := time.Now()
+	q.entries[videoId] = &Entry{
+		VideoId:   videoId,
+		Rendition: rendition,
+		NextProbe: now,
+		Added:     now,
+	}
+	q.dirty = true
+	return true
+}
+
+// Due returns the entries whose next probe time has passed.
+func (q *Queue) Due(now time.Time) []Entry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []Entry
+	for _, e := range q.entries {
+		if !e.NextProbe.After(now) {
+			due = append(due, *e)
+		}
+	}
+	return due
+}
+
+// Retry schedules the next probe with exponential backoff. The entry is
+// dropped once it reaches maxAttempts.
+func (q *Queue) Retry(videoId string, backoff time.Duration, maxAttempts int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.entries[videoId]
+	if !ok {
+		return
+	}
+	e.Attempts++
+	q.dirty = true
+	if e.Attempts >= maxAttempts {
+		delete(q.entries, videoId)
+		log.Printf("[INFO] [upgrade] Giving up on %s after %d attempts\n", videoId, e.Attempts)
+		return
+	}
+	shift := e.Attempts - 1
+	if shift > 10 {
+		shift = 10
+	}
+	e.NextProbe = time.Now().Add(backoff << shift)
+}
+
+func (q *Queue) Remove(videoId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.entries[videoId]; ok {
+		delete(q.entries, videoId)
+		q.dirty = true
+	}
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
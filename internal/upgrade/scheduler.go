@@ -0,0 +1,114 @@
+// Package upgrade remembers videos that were served from a fallback
+// rendition and periodically re-probes maxresdefault for them, so that
+// stale low quality thumbnails can be purged once YouTube generates the
+// high resolution one.
+package upgrade
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+)
+
+const maxres = "maxresdefault.jpg"
+
+// Probe reports whether maxresdefault is available for a video.
+type Probe func(videoId string) (bool, error)
+
+// PurgeHook is called once maxresdefault becomes available for a video,
+// so that cached copies of the lower rendition can be invalidated.
+type PurgeHook func(videoId string)
+
+var queue *Queue
+
+var hooksMu sync.RWMutex
+var hooks []PurgeHook
+
+// AddPurgeHook registers a function that is called for every upgraded video.
+func AddPurgeHook(h PurgeHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = append(hooks, h)
+}
+
+func emitPurge(videoId string) {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	for _, h := range hooks {
+		h(videoId)
+	}
+}
+
+// Track records that a video was served from the given rendition.
+// It does nothing if the worker is not running or the rendition is
+// already maxresdefault.
+func Track(videoId, rendition string) {
+	if queue == nil || rendition == maxres {
+		return
+	}
+	if queue.Add(videoId, rendition) {
+		log.Printf("[INFO] [upgrade] Queued %s (served %s)\n", videoId, rendition)
+	}
+}
+
+// Start loads the persisted queue and starts the background scheduler.
+func Start(probe Probe) {
+	c := config.Cfg.Upgrade
+	q := NewQueue(c.Queue_path, c.Queue_size)
+	if err := q.Load(); err != nil {
+		log.Printf("[ERROR] [upgrade] Failed to load queue from '%s': %s\n", c.Queue_path, err)
+	}
+	queue = q
+
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	log.Printf("[INFO] Starting upgrade worker with %d queued videos\n", q.Len())
+	go func() {
+		for {
+			time.Sleep(time.Duration(c.Interval) * time.Second)
+			runDue(q, probe, concurrency, time.Duration(c.Backoff)*time.Second, c.Max_attempts)
+			if err := q.Save(); err != nil {
+				log.Printf("[ERROR] [upgrade] Failed to save queue: %s\n", err)
+			}
+		}
+	}()
+}
+
+// runDue probes every due entry, running at most concurrency probes at once.
+func runDue(q *Queue, probe Probe, concurrency int, backoff time.Duration, maxAttempts int) {
+	due := q.Due(time.Now())
+	if len(due) == 0 {
+		return
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, e := range due {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(e Entry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ok, err := probe(e.VideoId)
+			if err != nil {
+				log.Printf("[ERROR] [upgrade] Failed to probe %s: %s\n", e.VideoId, err)
+			}
+			if !ok {
+				q.Retry(e.VideoId, backoff, maxAttempts)
+				return
+			}
+			q.Remove(e.VideoId)
+			log.Printf("[INFO] [upgrade] maxresdefault is now available for %s\n", e.VideoId)
+			emitPurge(e.VideoId)
+		}(e)
+	}
+	wg.Wait()
+}
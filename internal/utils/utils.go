@@ -2,10 +2,15 @@ package utils
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/javadalmasi/Thumbs/internal/httpc"
@@ -77,26 +82,70 @@ func PanicHandler(w http.ResponseWriter) {
 	}
 }
 
-// https://stackoverflow.com/a/41652605
-func DecryptQueryParams(encryptedQuery string, key string) (string, error) {
-	se, err := base64.StdEncoding.DecodeString(encryptedQuery)
+// EncryptQueryParams encrypts and authenticates a query string with
+// AES-GCM. The result is unpadded base64-url: a random nonce followed by
+// the sealed query. key must be 16, 24 or 32 bytes. The result only
+// decrypts with the same additionalData, which is authenticated but not
+// encrypted.
+func EncryptQueryParams(query string, key []byte, additionalData string) (string, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		log.Println("[ERROR] Error when decoding base64 string:", err)
 		return "", err
 	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(query), []byte(additionalData))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
 
-	cipher, err := aes.NewCipher([]byte(key)[0:16])
+// DecryptQueryParams reverses EncryptQueryParams. It fails if the query
+// was encrypted with another key or additional data, or has been tampered
+// with.
+func DecryptQueryParams(encryptedQuery string, key []byte, additionalData string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encryptedQuery)
 	if err != nil {
-		log.Println("[ERROR] Error initializating cipher.Block:", err)
 		return "", err
 	}
-	decrypted := make([]byte, len(se))
-	size := 16
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted query too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	query, err := gcm.Open(nil, nonce, ciphertext, []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return string(query), nil
+}
 
-	for bs, be := 0, size; bs < len(se); bs, be = bs+size, be+size {
-		cipher.Decrypt(decrypted[bs:be], se[bs:be])
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	paddingSize := int(decrypted[len(decrypted)-1])
-	return string(decrypted[0 : len(decrypted)-paddingSize]), nil
+// WriteFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
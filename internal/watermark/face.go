@@ -0,0 +1,158 @@
+package watermark
+
+import (
+	"image"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// face is a font.Face that rasterizes the outlines of an sfnt.Font. The
+// opentype.Face of our golang.org/x/image version only measures glyphs.
+// A face is not safe for concurrent use, the font it wraps is.
+type face struct {
+	f    *sfnt.Font
+	ppem fixed.Int26_6
+	buf  sfnt.Buffer
+	rast vector.Rasterizer
+}
+
+// newFace returns a face of f that is size pixels per em.
+func newFace(f *sfnt.Font, size int) *face {
+	return &face{f: f, ppem: fixed.I(size)}
+}
+
+func (f *face) Close() error { return nil }
+
+func (f *face) Metrics() font.Metrics {
+	m, err := f.f.Metrics(&f.buf, f.ppem, font.HintingNone)
+	if err != nil {
+		return font.Metrics{}
+	}
+	return m
+}
+
+func (f *face) Kern(r0, r1 rune) fixed.Int26_6 {
+	x0, _ := f.f.GlyphIndex(&f.buf, r0)
+	x1, _ := f.f.GlyphIndex(&f.buf, r1)
+	k, err := f.f.Kern(&f.buf, x0, x1, f.ppem, font.HintingNone)
+	if err != nil {
+		return 0
+	}
+	return k
+}
+
+func (f *face) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	x, err := f.f.GlyphIndex(&f.buf, r)
+	if err != nil {
+		return 0, false
+	}
+	advance, err := f.f.GlyphAdvance(&f.buf, x, f.ppem, font.HintingNone)
+	return advance, err == nil
+}
+
+func (f *face) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	advance, ok := f.GlyphAdvance(r)
+	if !ok {
+		return fixed.Rectangle26_6{}, 0, false
+	}
+	segments, ok := f.segments(r)
+	if !ok {
+		return fixed.Rectangle26_6{}, 0, false
+	}
+	return segmentBounds(segments), advance, true
+}
+
+// Glyph rasterizes r at dot into a new mask. Runes the font lacks are
+// drawn as its .notdef glyph.
+func (f *face) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	advance, ok := f.GlyphAdvance(r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+	segments, ok := f.segments(r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+
+	b := segmentBounds(segments)
+	dr := image.Rect(
+		(dot.X + b.Min.X).Floor(), (dot.Y + b.Min.Y).Floor(),
+		(dot.X + b.Max.X).Ceil(), (dot.Y + b.Max.Y).Ceil(),
+	)
+	mask := image.NewAlpha(image.Rect(0, 0, dr.Dx(), dr.Dy()))
+	if dr.Empty() {
+		// Spaces have an advance but nothing to draw
+		return dr, mask, image.Point{}, advance, true
+	}
+
+	// Segment coordinates are relative to dot, the mask starts at dr.Min
+	originX := float32(dot.X)/64 - float32(dr.Min.X)
+	originY := float32(dot.Y)/64 - float32(dr.Min.Y)
+	point := func(p fixed.Point26_6) (float32, float32) {
+		return originX + float32(p.X)/64, originY + float32(p.Y)/64
+	}
+	f.rast.Reset(dr.Dx(), dr.Dy())
+	for i, s := range segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			if i > 0 {
+				f.rast.ClosePath()
+			}
+			f.rast.MoveTo(point(s.Args[0]))
+		case sfnt.SegmentOpLineTo:
+			f.rast.LineTo(point(s.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			ax, ay := point(s.Args[0])
+			bx, by := point(s.Args[1])
+			f.rast.QuadTo(ax, ay, bx, by)
+		case sfnt.SegmentOpCubeTo:
+			ax, ay := point(s.Args[0])
+			bx, by := point(s.Args[1])
+			cx, cy := point(s.Args[2])
+			f.rast.CubeTo(ax, ay, bx, by, cx, cy)
+		}
+	}
+	f.rast.ClosePath()
+	f.rast.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return dr, mask, image.Point{}, advance, true
+}
+
+// segments loads the outline of r, scaled to the face size, with the Y
+// axis pointing down. It is only valid until the next call.
+func (f *face) segments(r rune) ([]sfnt.Segment, bool) {
+	x, err := f.f.GlyphIndex(&f.buf, r)
+	if err != nil {
+		return nil, false
+	}
+	segments, err := f.f.LoadGlyph(&f.buf, x, f.ppem, nil)
+	return segments, err == nil
+}
+
+// segmentBounds returns the bounds of the control points of a glyph, which
+// contain its outline.
+func segmentBounds(segments []sfnt.Segment) fixed.Rectangle26_6 {
+	var b fixed.Rectangle26_6
+	for i, s := range segments {
+		n := 1
+		switch s.Op {
+		case sfnt.SegmentOpQuadTo:
+			n = 2
+		case sfnt.SegmentOpCubeTo:
+			n = 3
+		}
+		for j, p := range s.Args[:n] {
+			if i == 0 && j == 0 {
+				b.Min, b.Max = p, p
+				continue
+			}
+			b.Min.X = min(b.Min.X, p.X)
+			b.Min.Y = min(b.Min.Y, p.Y)
+			b.Max.X = max(b.Max.X, p.X)
+			b.Max.Y = max(b.Max.Y, p.Y)
+		}
+	}
+	return b
+}
@@ -0,0 +1,52 @@
+package watermark
+
+import (
+	"sync"
+
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+)
+
+// DefaultFont is the font of text watermarks without a type.
+const DefaultFont = "goregular"
+
+// fontData holds the embedded TrueType fonts by name.
+var fontData = map[string][]byte{
+	"goregular":  goregular.TTF,
+	"gobold":     gobold.TTF,
+	"goitalic":   goitalic.TTF,
+	"gomedium":   gomedium.TTF,
+	"gomono":     gomono.TTF,
+	"gomonobold": gomonobold.TTF,
+}
+
+var (
+	fontsMu sync.Mutex
+	fonts   = map[string]*sfnt.Font{}
+)
+
+// HasFont reports whether name is an embedded font.
+func HasFont(name string) bool {
+	_, ok := fontData[name]
+	return ok
+}
+
+// loadFont parses an embedded font on first use.
+func loadFont(name string) (*sfnt.Font, error) {
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+	if f, ok := fonts[name]; ok {
+		return f, nil
+	}
+	f, err := sfnt.Parse(fontData[name])
+	if err != nil {
+		return nil, err
+	}
+	fonts[name] = f
+	return f, nil
+}
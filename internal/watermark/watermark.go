@@ -0,0 +1,355 @@
+// Package watermark draws text and image watermarks on processed images,
+// following the OSS watermark operation. Text is rendered with embedded
+// TrueType fonts, images are loaded from WATERMARK_DIR.
+package watermark
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Defaults and limits of the OSS watermark parameters.
+const (
+	DefaultSize    = 40
+	DefaultOpacity = 100
+	DefaultGravity = "se"
+	DefaultMargin  = 10
+	MaxSize        = 1000
+	MaxMargin      = 4096
+	MaxTextLength  = 64
+)
+
+var (
+	// ErrImageNotFound is returned when a watermark image is not in
+	// WATERMARK_DIR, or image watermarks are disabled.
+	ErrImageNotFound = errors.New("watermark image not found")
+	// ErrTooLarge is returned when the watermark would have more pixels
+	// than MAX_OUTPUT_PIXELS.
+	ErrTooLarge = errors.New("watermark too large")
+)
+
+// gravities maps the OSS gravity names to the column and row of the
+// watermark, 0 for left or top, 1 for center and 2 for right or bottom.
+var gravities = map[string][2]int{
+	"nw": {0, 0}, "north": {1, 0}, "ne": {2, 0},
+	"west": {0, 1}, "center": {1, 1}, "east": {2, 1},
+	"sw": {0, 2}, "south": {1, 2}, "se": {2, 2},
+}
+
+// Options describes a watermark. At least one of Text and Image is set,
+// and an image is drawn left of the text when both are.
+type Options struct {
+	Text string
+	// Font is the name of an embedded font, Size its size in pixels.
+	Font  string
+	Color color.NRGBA
+	Size  int
+	// Image is a file name in WATERMARK_DIR. Percent scales it to that
+	// percentage of the width of the watermarked image, 0 keeps its size.
+	Image   string
+	Percent int
+	// Opacity is 0 (invisible) to 100 (opaque).
+	Opacity int
+	// Gravity is the corner, edge or center the watermark is placed at,
+	// X and Y its distance from the left or right and top or bottom edge.
+	// With Tile, the watermark is repeated across the whole image with X
+	// and Y as the gaps between copies instead.
+	Gravity string
+	X, Y    int
+	Tile    bool
+}
+
+// Empty reports whether o draws nothing.
+func (o Options) Empty() bool {
+	return o.Text == "" && o.Image == ""
+}
+
+// String returns o as normalized OSS watermark parameters.
+func (o Options) String() string {
+	var params []string
+	if o.Text != "" {
+		params = append(params,
+			"text_"+encode(o.Text),
+			"type_"+encode(o.Font),
+			fmt.Sprintf("color_%02X%02X%02X", o.Color.R, o.Color.G, o.Color.B),
+			fmt.Sprintf("size_%d", o.Size))
+	}
+	if o.Image != "" {
+		params = append(params, "image_"+encode(o.Image), fmt.Sprintf("P_%d", o.Percent))
+	}
+	params = append(params, fmt.Sprintf("t_%d", o.Opacity))
+	if o.Tile {
+		params = append(params, "fill_1")
+	} else {
+		params = append(params, "g_"+o.Gravity)
+	}
+	params = append(params, fmt.Sprintf("x_%d", o.X), fmt.Sprintf("y_%d", o.Y))
+	return strings.Join(params, ",")
+}
+
+func encode(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// Decode decodes a base64url parameter, with or without padding, as OSS
+// encodes text, font and image names.
+func Decode(s string) (string, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	return string(b), err == nil
+}
+
+// ValidGravity reports whether g is an OSS gravity name.
+func ValidGravity(g string) bool {
+	_, ok := gravities[g]
+	return ok
+}
+
+// ValidImage reports whether name can be a file in WATERMARK_DIR. Paths
+// and hidden files are rejected.
+func ValidImage(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && filepath.Base(name) == name && !strings.ContainsRune(name, '\\')
+}
+
+// Apply draws the watermark on a copy of img.
+func Apply(img image.Image, o Options) (image.Image, error) {
+	dst := imaging.Clone(img)
+	bounds := dst.Bounds()
+	mark, err := render(o, bounds.Dx())
+	if err != nil {
+		return nil, err
+	}
+	size := mark.Bounds().Size()
+	if size.X == 0 || size.Y == 0 || o.Opacity == 0 {
+		return dst, nil
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(float64(o.Opacity) * 255 / 100))})
+
+	if o.Tile {
+		for y := 0; y < bounds.Dy(); y += size.Y + o.Y {
+			for x := 0; x < bounds.Dx(); x += size.X + o.X {
+				r := image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x, y).Add(size)}
+				draw.DrawMask(dst, r, mark, image.Point{}, mask, image.Point{}, draw.Over)
+			}
+		}
+		return dst, nil
+	}
+
+	g := gravities[o.Gravity]
+	at := image.Pt(
+		position(g[0], bounds.Dx(), size.X, o.X),
+		position(g[1], bounds.Dy(), size.Y, o.Y),
+	)
+	draw.DrawMask(dst, image.Rectangle{Min: at, Max: at.Add(size)}, mark, image.Point{}, mask, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+// position returns the offset of a watermark of size n in a dimension of
+// size total, for the column or row of a gravity.
+func position(slot, total, n, margin int) int {
+	switch slot {
+	case 0:
+		return margin
+	case 1:
+		return (total - n) / 2
+	}
+	return total - n - margin
+}
+
+// render draws the watermark at full opacity on a transparent canvas
+// that fits it, for an image width pixels wide.
+func render(o Options, width int) (*image.NRGBA, error) {
+	var logo image.Image
+	if o.Image != "" {
+		img, err := loadImage(o.Image)
+		if err != nil {
+			return nil, err
+		}
+		logo = img
+		if o.Percent > 0 {
+			w := max(1, width*o.Percent/100)
+			logo = imaging.Resize(img, w, 0, imaging.Lanczos)
+		}
+	}
+
+	var text *image.NRGBA
+	if o.Text != "" {
+		f, err := loadFont(o.Font)
+		if err != nil {
+			return nil, err
+		}
+		face := newFace(f, o.Size)
+		metrics := face.Metrics()
+		w := font.MeasureString(face, o.Text).Ceil()
+		h := (metrics.Ascent + metrics.Descent).Ceil()
+		if limit := config.Cfg.Limits.Max_output_pixels; limit > 0 && int64(w)*int64(h) > limit {
+			return nil, ErrTooLarge
+		}
+		text = image.NewNRGBA(image.Rect(0, 0, w, h))
+		d := font.Drawer{
+			Dst:  text,
+			Src:  image.NewUniform(o.Color),
+			Face: face,
+			Dot:  fixed.P(0, metrics.Ascent.Ceil()),
+		}
+		d.DrawString(o.Text)
+	}
+
+	switch {
+	case text == nil:
+		return imaging.Clone(logo), nil
+	case logo == nil:
+		return text, nil
+	}
+
+	// The image goes left of the text, both centered vertically, with a
+	// gap of a quarter of the font size
+	gap := o.Size / 4
+	lb, tb := logo.Bounds(), text.Bounds()
+	h := max(lb.Dy(), tb.Dy())
+	mark := image.NewNRGBA(image.Rect(0, 0, lb.Dx()+gap+tb.Dx(), h))
+	at := image.Pt(0, (h-lb.Dy())/2)
+	draw.Draw(mark, image.Rectangle{Min: at, Max: at.Add(lb.Size())}, logo, lb.Min, draw.Src)
+	at = image.Pt(lb.Dx()+gap, (h-tb.Dy())/2)
+	draw.Draw(mark, image.Rectangle{Min: at, Max: at.Add(tb.Size())}, text, tb.Min, draw.Src)
+	return mark, nil
+}
+
+// cachedImage is a decoded watermark image and the file it came from.
+type cachedImage struct {
+	modTime time.Time
+	size    int64
+	version string
+	img     image.Image
+}
+
+var (
+	imagesMu sync.Mutex
+	images   = map[string]cachedImage{}
+)
+
+// ImageVersion returns a hash of the content of a watermark image, which
+// changes whenever the file is replaced, or the empty string if it does
+// not exist.
+func ImageVersion(name string) string {
+	cached, err := lookupImage(name)
+	if err != nil {
+		return ""
+	}
+	return cached.version
+}
+
+// loadImage returns a decoded image from WATERMARK_DIR.
+func loadImage(name string) (image.Image, error) {
+	cached, err := lookupImage(name)
+	if err != nil {
+		return nil, err
+	}
+	return cached.img, nil
+}
+
+// lookupImage reads a watermark image from WATERMARK_DIR. Images are kept
+// in memory and read again when the file's modification time or size
+// changes.
+func lookupImage(name string) (cachedImage, error) {
+	dir := config.Cfg.Watermark.Dir
+	if dir == "" || !ValidImage(name) {
+		return cachedImage{}, ErrImageNotFound
+	}
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return cachedImage{}, ErrImageNotFound
+	}
+
+	imagesMu.Lock()
+	cached, ok := images[name]
+	imagesMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cachedImage{}, ErrImageNotFound
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return cachedImage{}, fmt.Errorf("decoding %s: %v", name, err)
+	}
+	sum := sha256.Sum256(data)
+	cached = cachedImage{modTime: info.ModTime(), size: info.Size(), version: hex.EncodeToString(sum[:8]), img: img}
+
+	imagesMu.Lock()
+	images[name] = cached
+	imagesMu.Unlock()
+	return cached, nil
+}
+
+// ChangeHook is called with the name of every watermark image that was
+// changed or removed.
+type ChangeHook func(name string)
+
+// Start checks WATERMARK_DIR for changed images every
+// WATERMARK_CHECK_INTERVAL seconds. Variants with the new image get new
+// cache keys on their own, the hook lets responses cached elsewhere be
+// purged.
+func Start(hook ChangeHook) {
+	c := config.Cfg.Watermark
+	go func() {
+		last := scanDir(c.Dir)
+		ticker := time.NewTicker(time.Duration(c.Check_interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			current := scanDir(c.Dir)
+			if current == nil {
+				// Keep the last state while the directory is unreadable
+				continue
+			}
+			for name, info := range last {
+				if now, ok := current[name]; !ok || !now.ModTime().Equal(info.ModTime()) || now.Size() != info.Size() {
+					log.Printf("[INFO] [watermark] Image '%s' changed\n", name)
+					hook(name)
+				}
+			}
+			last = current
+		}
+	}()
+}
+
+// scanDir returns the regular files of dir by name, or nil if it cannot
+// be read.
+func scanDir(dir string) map[string]os.FileInfo {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("[ERROR] [watermark] Failed to read '%s': %s\n", dir, err)
+		return nil
+	}
+	files := map[string]os.FileInfo{}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && ValidImage(entry.Name()) {
+			files[entry.Name()] = info
+		}
+	}
+	return files
+}
@@ -0,0 +1,181 @@
+// Package workers bounds the number of images processed at the same time.
+// Requests wait in a bounded queue for a free worker, with a separate
+// priority lane for small outputs, and give up after a deadline so that a
+// burst of resizes turns into 503s instead of exhausting memory.
+package workers
+
+import (
+	"errors"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/javadalmasi/Thumbs/internal/config"
+	"github.com/javadalmasi/Thumbs/internal/metrics"
+)
+
+// ErrSaturated is returned when the queue is full or the wait deadline
+// passed before a worker became free.
+var ErrSaturated = errors.New("processing queue saturated")
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// Pool hands out a fixed number of worker slots. Waiters in the small
+// lane are served before those in the large lane, each lane in order.
+type Pool struct {
+	mu        sync.Mutex
+	workers   int
+	running   int
+	queueSize int
+	maxWait   time.Duration
+	small     []*waiter
+	large     []*waiter
+}
+
+var pool *Pool
+
+func NewPool(workers, queueSize int, maxWait time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{
+		workers:   workers,
+		queueSize: queueSize,
+		maxWait:   maxWait,
+	}
+}
+
+// Start creates the process wide pool. Without it, Run calls the function
+// directly.
+func Start() {
+	c := config.Cfg.Processing
+	workers := c.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	p := NewPool(workers, c.Queue_size, time.Duration(c.Max_wait)*time.Millisecond)
+	pool = p
+
+	metrics.Gauge("processing_queue_depth", func() any { return p.Queued() })
+	metrics.Gauge("processing_running", func() any { return p.Running() })
+	metrics.Gauge("processing_wait_avg_ms", func() any {
+		waits := metrics.Get("processing_waits")
+		if waits == 0 {
+			return 0.0
+		}
+		return float64(metrics.Get("processing_wait_ms")) / float64(waits)
+	})
+	log.Printf("[INFO] Processing with %d workers and a queue of %d\n", workers, c.Queue_size)
+}
+
+// Acquire waits for a free worker. It fails with ErrSaturated if the
+// queue is full or no worker became free within the wait deadline.
+func (p *Pool) Acquire(small bool) error {
+	p.mu.Lock()
+	if p.running < p.workers && len(p.small)+len(p.large) == 0 {
+		p.running++
+		p.mu.Unlock()
+		metrics.Inc("processing_waits")
+		return nil
+	}
+	if len(p.small)+len(p.large) >= p.queueSize {
+		p.mu.Unlock()
+		metrics.Inc("processing_rejected")
+		return ErrSaturated
+	}
+	w := &waiter{ready: make(chan struct{})}
+	if small {
+		p.small = append(p.small, w)
+	} else {
+		p.large = append(p.large, w)
+	}
+	p.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(p.maxWait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		p.mu.Lock()
+		if !w.granted {
+			p.small = remove(p.small, w)
+			p.large = remove(p.large, w)
+			p.mu.Unlock()
+			metrics.Inc("processing_rejected")
+			return ErrSaturated
+		}
+		// Granted just as the deadline passed, use the worker
+		p.mu.Unlock()
+	}
+	metrics.Inc("processing_waits")
+	metrics.Add("processing_wait_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// Release frees a worker, handing it straight to the next waiter.
+func (p *Pool) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var next *waiter
+	if len(p.small) > 0 {
+		next, p.small = p.small[0], p.small[1:]
+	} else if len(p.large) > 0 {
+		next, p.large = p.large[0], p.large[1:]
+	}
+	if next == nil {
+		p.running--
+		return
+	}
+	next.granted = true
+	close(next.ready)
+}
+
+func (p *Pool) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.small) + len(p.large)
+}
+
+func (p *Pool) Running() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+func remove(lane []*waiter, w *waiter) []*waiter {
+	for i, x := range lane {
+		if x == w {
+			return append(lane[:i], lane[i+1:]...)
+		}
+	}
+	return lane
+}
+
+// Run runs fn on a worker of the process wide pool. small selects the
+// priority lane.
+func Run(small bool, fn func()) error {
+	if pool == nil {
+		fn()
+		return nil
+	}
+	if err := pool.Acquire(small); err != nil {
+		return err
+	}
+	defer pool.Release()
+	fn()
+	return nil
+}
+
+// RetryAfter is how long a client should wait after ErrSaturated.
+func RetryAfter() time.Duration {
+	if pool == nil || pool.maxWait < time.Second {
+		return time.Second
+	}
+	return pool.maxWait
+}